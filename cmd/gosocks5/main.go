@@ -23,6 +23,10 @@ const (
 
 func main() {
 	var help = flag.Bool("h", false, "print usage and exit")
+	var export = flag.String("export", "", "export traffic accounting as csv|json to stdout and exit, the server must be stopped")
+	var from = flag.String("from", "", "export intervals starting at or after the time, RFC 3339 or 2006-01-02")
+	var to = flag.String("to", "", "export intervals starting before the time, RFC 3339 or 2006-01-02")
+	var user = flag.String("user", "", "export the traffic of the user only")
 	flag.Parse()
 	if *help == true {
 		config.PrintUsage(configPrefix)
@@ -35,6 +39,12 @@ func main() {
 		log.Printf("failed to create config: %v", err)
 		config.PrintUsage(configPrefix)
 	}
+	if *export != "" {
+		if err := app.Export(os.Stdout, cfg, *export, *from, *to, *user); err != nil {
+			log.Fatalf("failed to export traffic accounting: %v", err)
+		}
+		return
+	}
 	lg, err := logger.NewLogger(cfg.LogLevel)
 	if err != nil {
 		log.Fatalf("failed to create logger: %v", err)
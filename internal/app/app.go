@@ -10,7 +10,7 @@ import (
 
 func Run(ctx context.Context, wg *sync.WaitGroup, cfg *config.Config, log *logger.Logger, appName string, appVersion string) {
 	log.Lg.Info().Msgf("start %v ver %v", appName, appVersion)
-	svc, err := services.NewService(ctx, log, cfg.Listen, cfg.Auth)
+	svc, err := services.NewService(ctx, log, cfg)
 	if err != nil {
 		log.Lg.Fatal().Msgf("failed to create service: %v", err)
 	}
@@ -0,0 +1,31 @@
+package app
+
+import (
+	"fmt"
+	"github.com/dossif/gosocks5/internal/config"
+	"github.com/dossif/gosocks5/pkg/accounting"
+	"io"
+)
+
+// Export writes the traffic accounting matching the filter in the format csv or json
+func Export(w io.Writer, cfg *config.Config, format, from, to, user string) error {
+	if cfg.Accounting.Db == "" {
+		return fmt.Errorf("traffic accounting database is not configured")
+	}
+	f, err := accounting.ParseFilter(from, to, user)
+	if err != nil {
+		return err
+	}
+	a, err := accounting.Open(cfg.Accounting.Db)
+	if err != nil {
+		return fmt.Errorf("%v, use the http api /traffic of a running server", err)
+	}
+	defer func() {
+		_ = a.Close()
+	}()
+	usage, err := a.Usage(f)
+	if err != nil {
+		return err
+	}
+	return accounting.Export(w, format, usage)
+}
@@ -5,8 +5,12 @@ import (
 	"encoding/base64"
 	"fmt"
 	"github.com/dossif/gosocks5/pkg/logger"
+	"github.com/dossif/gosocks5/pkg/socks5"
 	"github.com/go-ldap/ldap"
 	"github.com/jellydator/ttlcache/v3"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -15,6 +19,11 @@ const (
 	authFalseCache = time.Second * 10
 )
 
+var (
+	_ socks5.RateLimitStore = (*Ldap)(nil)
+	_ socks5.AttributeStore = (*Ldap)(nil)
+)
+
 type Ldap struct {
 	Url      string
 	BindUser string
@@ -23,6 +32,18 @@ type Ldap struct {
 	Filter   string
 	Log      *logger.Logger
 	Cache    *ttlcache.Cache[string, string]
+	// UploadAttr and DownloadAttr are optional user attributes
+	// with rate limits in bytes per second
+	UploadAttr   string
+	DownloadAttr string
+	// DefaultLimit is used for missing or invalid attributes
+	DefaultLimit socks5.RateLimit
+	// GroupAttr is an optional user attribute with the group DNs, e.g. memberOf
+	GroupAttr string
+
+	mu     sync.Mutex
+	limits map[string]socks5.RateLimit
+	groups map[string][]string
 }
 
 func NewLdap(log logger.Logger, url, bindUser, bindPass, baseDn, filter string) (*Ldap, error) {
@@ -37,9 +58,36 @@ func NewLdap(log logger.Logger, url, bindUser, bindPass, baseDn, filter string)
 		Filter:   filter,
 		Log:      &log,
 		Cache:    cache,
+		limits:   make(map[string]socks5.RateLimit),
+		groups:   make(map[string][]string),
 	}, nil
 }
 
+// RateLimit returns the limits read from the user attributes on the last ldap check
+func (l *Ldap) RateLimit(user string) (socks5.RateLimit, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	limit, ok := l.limits[user]
+	return limit, ok
+}
+
+// Groups returns the group names read from GroupAttr on the last ldap check.
+// The name is the value of the first RDN of the group DN, e.g. devops for cn=devops,dc=example,dc=com.
+func (l *Ldap) Groups(user string) []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.groups[user]
+}
+
+// Attributes returns the groups of the user as Groups, comma separated, for policy rules
+func (l *Ldap) Attributes(user string) map[string]string {
+	groups := l.Groups(user)
+	if len(groups) == 0 {
+		return nil
+	}
+	return map[string]string{"Groups": strings.Join(groups, ",")}
+}
+
 func (l *Ldap) Valid(user string, pass string) bool {
 	l.Cache.DeleteExpired()
 	switch l.checkCache(user, pass) {
@@ -89,7 +137,13 @@ func (l *Ldap) checkLdap(user string, pass string) bool {
 		return false
 	}
 	filter := fmt.Sprintf(l.Filter, ldap.EscapeFilter(user))
-	searchReq := ldap.NewSearchRequest(l.BaseDn, ldap.ScopeWholeSubtree, 0, 0, 0, false, filter, []string{}, []ldap.Control{})
+	var attrs []string
+	for _, attr := range []string{l.UploadAttr, l.DownloadAttr, l.GroupAttr} {
+		if attr != "" {
+			attrs = append(attrs, attr)
+		}
+	}
+	searchReq := ldap.NewSearchRequest(l.BaseDn, ldap.ScopeWholeSubtree, 0, 0, 0, false, filter, attrs, []ldap.Control{})
 	result, err := client.Search(searchReq)
 	if err != nil {
 		l.Log.Lg.Warn().Msgf("failed to search ldap user %v with filter %v: %v", user, filter, err)
@@ -100,8 +154,10 @@ func (l *Ldap) checkLdap(user string, pass string) bool {
 		return false
 	}
 	var userDn string
+	var entry *ldap.Entry
 	for _, res := range result.Entries {
 		userDn = res.DN
+		entry = res
 	}
 	err = client.Bind(userDn, pass)
 	if err != nil {
@@ -109,9 +165,58 @@ func (l *Ldap) checkLdap(user string, pass string) bool {
 		return false
 	}
 	defer client.Close()
+	if l.UploadAttr != "" || l.DownloadAttr != "" {
+		l.setRateLimit(user, entry)
+	}
+	if l.GroupAttr != "" {
+		l.setGroups(user, entry)
+	}
 	return true
 }
 
+// setGroups keeps the group names of the user attribute
+func (l *Ldap) setGroups(user string, entry *ldap.Entry) {
+	var groups []string
+	for _, value := range entry.GetAttributeValues(l.GroupAttr) {
+		groups = append(groups, groupName(value))
+	}
+	l.mu.Lock()
+	l.groups[user] = groups
+	l.mu.Unlock()
+}
+
+// groupName returns the value of the first RDN of the DN, the value itself if it is not a DN
+func groupName(value string) string {
+	dn, err := ldap.ParseDN(value)
+	if err != nil || len(dn.RDNs) == 0 || len(dn.RDNs[0].Attributes) == 0 {
+		return value
+	}
+	return dn.RDNs[0].Attributes[0].Value
+}
+
+// setRateLimit keeps the limits of the user attributes
+func (l *Ldap) setRateLimit(user string, entry *ldap.Entry) {
+	attrRate := func(attr string, def socks5.Bandwidth) socks5.Bandwidth {
+		value := entry.GetAttributeValue(attr)
+		if attr == "" || value == "" {
+			return def
+		}
+		rate, err := strconv.Atoi(value)
+		if err != nil {
+			l.Log.Lg.Warn().Msgf("invalid ldap rate limit %v of user %v: %v", attr, user, value)
+			return def
+		}
+		return socks5.Bandwidth{Rate: rate, Burst: def.Burst}
+	}
+	limit := socks5.RateLimit{
+		Upload:   attrRate(l.UploadAttr, l.DefaultLimit.Upload),
+		Download: attrRate(l.DownloadAttr, l.DefaultLimit.Download),
+	}
+	l.mu.Lock()
+	l.limits[user] = limit
+	l.mu.Unlock()
+}
+
 func hashPass(pass string) string {
 	h := sha256.New()
 	h.Write([]byte(pass))
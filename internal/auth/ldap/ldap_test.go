@@ -1,8 +1,32 @@
 package ldap
 
 import (
+	"github.com/dossif/gosocks5/pkg/logger"
 	"testing"
 )
 
 func TestValid(t *testing.T) {
 }
+
+func TestGroupName(t *testing.T) {
+	for value, expected := range map[string]string{
+		"cn=devops,cn=groups,cn=accounts,dc=example,dc=com": "devops",
+		"CN=Domain Users,DC=example,DC=com":                 "Domain Users",
+		"devops":                                            "devops",
+	} {
+		if name := groupName(value); name != expected {
+			t.Errorf("%v: bad: %v", value, name)
+		}
+	}
+}
+
+func TestAttributes(t *testing.T) {
+	l, _ := NewLdap(logger.Logger{}, "", "", "", "", "")
+	l.groups["alice"] = []string{"devops", "Domain Users"}
+	if attrs := l.Attributes("alice"); attrs["Groups"] != "devops,Domain Users" {
+		t.Fatalf("bad: %v", attrs)
+	}
+	if attrs := l.Attributes("bob"); attrs != nil {
+		t.Fatalf("bad: %v", attrs)
+	}
+}
@@ -1,66 +1,488 @@
 package services
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"github.com/dossif/gosocks5/internal/auth/ldap"
 	"github.com/dossif/gosocks5/internal/auth/static"
 	"github.com/dossif/gosocks5/internal/config"
+	"github.com/dossif/gosocks5/pkg/accounting"
+	"github.com/dossif/gosocks5/pkg/certwatch"
+	"github.com/dossif/gosocks5/pkg/chain"
 	"github.com/dossif/gosocks5/pkg/logger"
+	"github.com/dossif/gosocks5/pkg/metrics"
+	"github.com/dossif/gosocks5/pkg/policy"
+	"github.com/dossif/gosocks5/pkg/quota"
+	"github.com/dossif/gosocks5/pkg/resolver"
 	"github.com/dossif/gosocks5/pkg/socks5"
-	"golang.org/x/net/context"
+	"net/http"
+	"os"
+	"strings"
+	"time"
 )
 
 const (
-	proto = "tcp"
+	proto      = "tcp"
+	apiTimeout = time.Second * 10
 )
 
+// modernCiphers are tls 1.2 suites with forward secrecy and aead only
+var modernCiphers = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+}
+
 type Service struct {
-	Ctx    context.Context
-	Lg     *logger.Logger
-	Srv    socks5.Server
-	Listen string
+	Ctx        context.Context
+	Lg         *logger.Logger
+	Srv        socks5.Server
+	Listen     string
+	HttpListen string
+	ApiListen  string
+	Tls        *tls.Config
+	Accounting *accounting.Accountant
+	Quota      *quota.Manager
+	Metrics    *metrics.Metrics
 }
 
-func NewService(ctx context.Context, lg *logger.Logger, listen string, auth config.Auth) (*Service, error) {
-	var authMethod socks5.Authenticator
-	switch auth.Method {
-	case "none":
-		authMethod = socks5.NoAuthAuthenticator{}
-		lg.Lg.Info().Msgf("auth mode: none")
+func NewService(ctx context.Context, lg *logger.Logger, cfg *config.Config) (*Service, error) {
+	auth := cfg.Auth
+	var authMethods []socks5.Authenticator
+	codes := make(map[string]uint8)
+	for _, method := range auth.Method {
+		authMethod, err := newAuthenticator(lg, cfg, method)
+		if err != nil {
+			return &Service{}, err
+		}
+		for name, code := range codes {
+			if code == authMethod.GetCode() {
+				return &Service{}, fmt.Errorf("auth methods %v and %v can not be used together", name, method)
+			}
+		}
+		codes[method] = authMethod.GetCode()
+		authMethods = append(authMethods, authMethod)
+	}
+	var authPolicies []socks5.AuthPolicy
+	for _, n := range auth.Networks {
+		p := socks5.AuthPolicy{Networks: n.Networks}
+		for _, method := range n.Methods {
+			code, ok := codes[method]
+			if !ok {
+				return &Service{}, fmt.Errorf("auth method %v for %v is not enabled", method, n.Networks)
+			}
+			p.Methods = append(p.Methods, code)
+		}
+		authPolicies = append(authPolicies, p)
+		lg.Lg.Info().Msgf("auth mode for %v: %v", n.Networks, strings.Join(n.Methods, ","))
+	}
+	conf := &socks5.Config{
+		AuthMethods:      authMethods,
+		AuthPolicies:     authPolicies,
+		FamilyPreference: dialFamily(cfg.Dial.Family),
+		DialTimeout:      cfg.Dial.Timeout,
+		FallbackDelay:    cfg.Dial.FallbackDelay,
+		RemoteResolve:    cfg.Dns.Remote,
+		GlobalRateLimit:  rateLimit(cfg.RateLimit.Upload, cfg.RateLimit.Download, cfg.RateLimit.Burst),
+		UserRateLimit:    rateLimit(cfg.RateLimit.UserUpload, cfg.RateLimit.UserDownload, cfg.RateLimit.Burst),
+		ConnQuota: socks5.ConnQuota{
+			Total:     cfg.MaxConns.Total,
+			PerSource: cfg.MaxConns.PerSource,
+			PerUser:   cfg.MaxConns.PerUser,
+		},
+	}
+	if cfg.MaxConns.Total > 0 || cfg.MaxConns.PerSource > 0 || cfg.MaxConns.PerUser > 0 {
+		lg.Lg.Info().Msgf("max connections: total %v, per source %v, per user %v",
+			cfg.MaxConns.Total, cfg.MaxConns.PerSource, cfg.MaxConns.PerUser)
+	}
+	if cfg.RateLimit.Upload > 0 || cfg.RateLimit.Download > 0 || cfg.RateLimit.UserUpload > 0 || cfg.RateLimit.UserDownload > 0 {
+		lg.Lg.Info().Msgf("rate limit: upload %v, download %v, user upload %v, user download %v bytes per second",
+			cfg.RateLimit.Upload, cfg.RateLimit.Download, cfg.RateLimit.UserUpload, cfg.RateLimit.UserDownload)
+	}
+	if cfg.Policy != "" {
+		p, err := policy.Load(cfg.Policy)
+		if err != nil {
+			return &Service{}, fmt.Errorf("failed to load policy: %v", err)
+		}
+		conf.Rules = p
+		lg.Lg.Info().Msgf("policy: %v, %v rules, default %v", cfg.Policy, len(p.Rules), p.Default)
+	}
+	if len(cfg.Dns.Servers) > 0 || len(cfg.Dns.Routes) > 0 || cfg.Dns.Hosts != "" || cfg.Dns.Unmatched == "nxdomain" {
+		res, err := newResolver(ctx, lg, cfg.Dns)
+		if err != nil {
+			return &Service{}, fmt.Errorf("failed to create dns resolver: %v", err)
+		}
+		conf.Resolver = res
+		lg.Lg.Info().Msgf("dns servers: %v, routes: %v, unmatched: %v", cfg.Dns.Servers, cfg.Dns.Routes, cfg.Dns.Unmatched)
+	}
+	if len(cfg.Upstream) > 0 {
+		ch, err := chain.NewChain(cfg.Upstream)
+		if err != nil {
+			return &Service{}, fmt.Errorf("failed to create upstream chain: %v", err)
+		}
+		conf.Dial = ch.DialContext
+		lg.Lg.Info().Msgf("upstream chain: %v", ch)
+	}
+	if cfg.Dns.Remote {
+		// Without an upstream the system resolver of the local dialer would bypass
+		// the configured dns servers and the rules on resolved addresses
+		if len(cfg.Upstream) == 0 {
+			return &Service{}, fmt.Errorf("remote dns resolution requires an upstream chain")
+		}
+		lg.Lg.Info().Msgf("dns: destination names are resolved remotely")
+	} else if p, ok := conf.Rules.(*policy.Policy); ok && p.HasRemoteResolve() {
+		if len(cfg.Upstream) == 0 {
+			return &Service{}, fmt.Errorf("policy rules with remote resolution require an upstream chain")
+		}
+		lg.Lg.Info().Msgf("dns: destination names are resolved remotely by policy")
+	}
+	var tlsConf *tls.Config
+	if cfg.Tls.Cert != "" {
+		var err error
+		tlsConf, err = newTlsConfig(ctx, lg, cfg.Tls)
+		if err != nil {
+			return &Service{}, fmt.Errorf("failed to create tls config: %v", err)
+		}
+		if _, ok := codes["cert"]; ok {
+			tlsConf.ClientAuth = tls.RequestClientCert
+		}
+		lg.Lg.Info().Msgf("tls: min version %v, ciphers %v", cfg.Tls.MinVersion, cfg.Tls.Ciphers)
+	}
+	var acc *accounting.Accountant
+	if cfg.Accounting.Db != "" {
+		var err error
+		acc, err = accounting.NewAccountant(ctx, lg, cfg.Accounting.Db, cfg.Accounting.Interval, cfg.Accounting.Flush)
+		if err != nil {
+			return &Service{}, fmt.Errorf("failed to create traffic accounting: %v", err)
+		}
+		conf.Traffic = acc
+		lg.Lg.Info().Msgf("traffic accounting: %v, interval %v", cfg.Accounting.Db, acc.Interval)
+	}
+	var qm *quota.Manager
+	if cfg.Quota.Db != "" {
+		var err error
+		qm, err = newQuota(ctx, lg, cfg.Quota, authMethods)
+		if err != nil {
+			return &Service{}, fmt.Errorf("failed to create data quota: %v", err)
+		}
+		conf.DataQuota = qm
+		conf.CloseOverQuota = cfg.Quota.CloseSessions
+		lg.Lg.Info().Msgf("data quota: %v, default %v, %v users, %v groups, close sessions %v",
+			cfg.Quota.Db, cfg.Quota.Default.String(), len(cfg.Quota.Users), len(cfg.Quota.Groups), cfg.Quota.CloseSessions)
+	}
+	var m *metrics.Metrics
+	if cfg.ApiListen != "" {
+		m = metrics.New()
+		conf.Metrics = m
+	}
+	srv, err := socks5.New(ctx, lg, conf)
+	if err != nil {
+		return &Service{}, fmt.Errorf("failed to create socks5 server: %v", err)
+	}
+	return &Service{
+		Ctx:        ctx,
+		Lg:         lg,
+		Srv:        *srv,
+		Listen:     cfg.Listen,
+		HttpListen: cfg.HttpListen,
+		ApiListen:  cfg.ApiListen,
+		Tls:        tlsConf,
+		Accounting: acc,
+		Quota:      qm,
+		Metrics:    m,
+	}, nil
+}
+
+// newAuthenticator creates the authenticator of the auth method
+func newAuthenticator(lg *logger.Logger, cfg *config.Config, method string) (socks5.Authenticator, error) {
+	auth := cfg.Auth
+	switch method {
 	case "static":
 		st, err := static.NewStatic(auth.Static.User, auth.Static.Pass)
 		if err != nil {
-			return &Service{}, fmt.Errorf("failed to create static auth: %v", err)
+			return nil, fmt.Errorf("failed to create static auth: %v", err)
 		}
-		authMethod = socks5.UserPassAuthenticator{Credentials: st}
 		lg.Lg.Info().Msgf("auth mode: static")
+		return socks5.UserPassAuthenticator{Credentials: st}, nil
 	case "ldap":
 		ld, err := ldap.NewLdap(*lg, auth.Ldap.Url, auth.Ldap.BindUser, auth.Ldap.BindPass, auth.Ldap.BaseDn, auth.Ldap.Filter)
 		if err != nil {
-			return &Service{}, fmt.Errorf("failed to create ldap auth: %v", err)
+			return nil, fmt.Errorf("failed to create ldap auth: %v", err)
 		}
-		authMethod = socks5.UserPassAuthenticator{Credentials: ld}
+		ld.UploadAttr = auth.Ldap.UploadAttr
+		ld.DownloadAttr = auth.Ldap.DownloadAttr
+		ld.DefaultLimit = rateLimit(cfg.RateLimit.UserUpload, cfg.RateLimit.UserDownload, cfg.RateLimit.Burst)
+		ld.GroupAttr = auth.Ldap.GroupAttr
 		lg.Lg.Info().Msgf("auth mode: ldap")
+		return socks5.UserPassAuthenticator{Credentials: ld}, nil
+	case "cert":
+		if cfg.Tls.Cert == "" {
+			return nil, fmt.Errorf("failed to create cert auth: tls is not enabled")
+		}
+		ca, err := newCertAuth(auth.Cert)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create cert auth: %v", err)
+		}
+		lg.Lg.Info().Msgf("auth mode: cert")
+		return ca, nil
+	case "token":
+		if len(auth.Token.Keys) == 0 {
+			return nil, fmt.Errorf("failed to create token auth: no keys")
+		}
+		keys := make(map[string][]byte, len(auth.Token.Keys))
+		for kid, key := range auth.Token.Keys {
+			keys[kid] = []byte(key)
+		}
+		lg.Lg.Info().Msgf("auth mode: token, %v keys", len(keys))
+		return socks5.TokenAuthenticator{Keys: keys}, nil
+	default:
+		lg.Lg.Info().Msgf("auth mode: none")
+		return socks5.NoAuthAuthenticator{}, nil
 	}
-	conf := &socks5.Config{
-		AuthMethods: []socks5.Authenticator{authMethod},
+}
+
+// rateLimit converts the config values to socks5.RateLimit
+func rateLimit(upload, download, burst int) socks5.RateLimit {
+	return socks5.RateLimit{
+		Upload:   socks5.Bandwidth{Rate: upload, Burst: burst},
+		Download: socks5.Bandwidth{Rate: download, Burst: burst},
 	}
-	srv, err := socks5.New(ctx, lg, conf)
+}
+
+// quotaLimits converts the config value to quota.Limits
+func quotaLimits(l config.QuotaLimits) quota.Limits {
+	return quota.Limits{quota.Daily: l.Daily, quota.Weekly: l.Weekly, quota.Monthly: l.Monthly}
+}
+
+// newQuota creates the data quota manager, group quotas use the groups of ldap users
+func newQuota(ctx context.Context, lg *logger.Logger, cfg config.Quota, authMethods []socks5.Authenticator) (*quota.Manager, error) {
+	if cfg.ResetHour < 0 || cfg.ResetHour > 23 {
+		return nil, fmt.Errorf("invalid reset hour %v", cfg.ResetHour)
+	}
+	if cfg.ResetDay < 1 || cfg.ResetDay > 28 {
+		return nil, fmt.Errorf("invalid reset day %v", cfg.ResetDay)
+	}
+	loc, err := time.LoadLocation(cfg.Timezone)
 	if err != nil {
-		return &Service{}, fmt.Errorf("failed to create socks5 server: %v", err)
+		return nil, fmt.Errorf("invalid timezone %v: %v", cfg.Timezone, err)
 	}
-	return &Service{
-		Ctx:    ctx,
-		Lg:     lg,
-		Srv:    *srv,
-		Listen: listen,
-	}, nil
+	conf := quota.Config{
+		Default: quotaLimits(cfg.Default),
+		Users:   make(map[string]quota.Limits, len(cfg.Users)),
+		Groups:  make(map[string]quota.Limits, len(cfg.Groups)),
+		Schedule: quota.Schedule{
+			Hour:     cfg.ResetHour,
+			Weekday:  time.Weekday(cfg.ResetWeekday),
+			Day:      cfg.ResetDay,
+			Location: loc,
+		},
+	}
+	for user, limits := range cfg.Users {
+		conf.Users[user] = quotaLimits(limits)
+	}
+	for group, limits := range cfg.Groups {
+		conf.Groups[group] = quotaLimits(limits)
+	}
+	if len(cfg.Groups) > 0 {
+		for _, a := range authMethods {
+			if upa, ok := a.(socks5.UserPassAuthenticator); ok {
+				if ld, ok := upa.Credentials.(*ldap.Ldap); ok && ld.GroupAttr != "" {
+					conf.UserGroups = ld.Groups
+				}
+			}
+		}
+		if conf.UserGroups == nil {
+			return nil, fmt.Errorf("group quotas require ldap auth with the group attribute")
+		}
+	}
+	return quota.NewManager(ctx, lg, cfg.Db, conf, 0)
 }
 
-func (s *Service) Start() error {
-	err := s.Srv.ListenAndServe(proto, s.Listen)
+// dialFamily converts the config value to socks5.FamilyPreference
+func dialFamily(family config.DialFamily) socks5.FamilyPreference {
+	switch family {
+	case "prefer-ipv4":
+		return socks5.PreferIPv4
+	case "ipv4-only":
+		return socks5.IPv4Only
+	case "ipv6-only":
+		return socks5.IPv6Only
+	default:
+		return socks5.PreferIPv6
+	}
+}
+
+// newResolver creates a resolver routing names by hosts overrides and domain suffixes
+// to caching resolvers of the configured dns servers
+func newResolver(ctx context.Context, lg *logger.Logger, cfg config.Dns) (socks5.NameResolver, error) {
+	conf := resolver.Config{
+		Timeout:       cfg.Timeout,
+		MinTTL:        cfg.MinTtl,
+		MaxTTL:        cfg.MaxTtl,
+		NegativeTTL:   cfg.NegativeTtl,
+		Bootstrap:     cfg.Bootstrap,
+		TLSServerName: cfg.TlsServerName,
+		DoHMethod:     string(cfg.DohMethod),
+	}
+	if cfg.Ca != "" {
+		pem, err := os.ReadFile(cfg.Ca)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ca bundle: %v", err)
+		}
+		conf.RootCAs = x509.NewCertPool()
+		if !conf.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in ca bundle %v", cfg.Ca)
+		}
+	}
+
+	var def socks5.NameResolver = socks5.DNSResolver{}
+	if len(cfg.Servers) > 0 {
+		conf.Servers = cfg.Servers
+		res, err := resolver.NewResolver(ctx, lg, conf)
+		if err != nil {
+			return nil, err
+		}
+		def = res
+	}
+	if len(cfg.Routes) == 0 && cfg.Hosts == "" && cfg.Unmatched != "nxdomain" {
+		return def, nil
+	}
+
+	routes := make(map[string]socks5.NameResolver, len(cfg.Routes))
+	for suffix, servers := range cfg.Routes {
+		conf.Servers = servers
+		res, err := resolver.NewResolver(ctx, lg, conf)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create resolver for %v: %v", suffix, err)
+		}
+		routes[suffix] = res
+	}
+	var hosts *resolver.Hosts
+	if cfg.Hosts != "" {
+		var err error
+		hosts, err = resolver.NewHosts(ctx, lg, cfg.Hosts, resolver.DefaultHostsInterval)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load hosts: %v", err)
+		}
+	}
+	if cfg.Unmatched == "nxdomain" {
+		def = nil
+	}
+	return resolver.NewRouter(hosts, routes, def), nil
+}
+
+// newCertAuth creates a client certificate authenticator
+func newCertAuth(cfg config.Cert) (*socks5.ClientCertAuthenticator, error) {
+	pem, err := os.ReadFile(cfg.Ca)
 	if err != nil {
-		return fmt.Errorf("failed to start gosocks5 server: %v", err)
+		return nil, fmt.Errorf("failed to read ca bundle: %v", err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in ca bundle %v", cfg.Ca)
+	}
+	ca := &socks5.ClientCertAuthenticator{Roots: roots}
+	switch cfg.Username {
+	case "cn":
+		ca.Username = socks5.CertCommonName
+	case "san":
+		ca.Username = socks5.CertSAN
+	default:
+		ca.Username, err = socks5.CertTemplate(cfg.Username)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ca, nil
+}
+
+// newTlsConfig creates a tls config with the certificate reloaded on change
+func newTlsConfig(ctx context.Context, lg *logger.Logger, cfg config.Tls) (*tls.Config, error) {
+	watcher, err := certwatch.NewWatcher(ctx, lg, cfg.Cert, cfg.Key, certwatch.DefaultInterval)
+	if err != nil {
+		return nil, err
+	}
+	tlsConf := &tls.Config{
+		GetCertificate: watcher.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+	if cfg.MinVersion == "1.3" {
+		tlsConf.MinVersion = tls.VersionTLS13
+	}
+	if cfg.Ciphers == "modern" {
+		tlsConf.CipherSuites = modernCiphers
+	}
+	return tlsConf, nil
+}
+
+func (s *Service) Start() error {
+	if s.Accounting != nil {
+		defer func() {
+			if err := s.Accounting.Close(); err != nil {
+				s.Lg.Lg.Warn().Msgf("failed to save traffic accounting: %v", err)
+			}
+		}()
+	}
+	if s.Quota != nil {
+		defer func() {
+			if err := s.Quota.Close(); err != nil {
+				s.Lg.Lg.Warn().Msgf("failed to save data quota usage: %v", err)
+			}
+		}()
+	}
+	errCh := make(chan error, 3)
+	listeners := 1
+	go func() {
+		if s.Tls != nil {
+			errCh <- s.Srv.ListenAndServeTLS(proto, s.Listen, s.Tls)
+		} else {
+			errCh <- s.Srv.ListenAndServe(proto, s.Listen)
+		}
+	}()
+	if s.HttpListen != "" {
+		listeners++
+		go func() {
+			errCh <- s.Srv.ListenAndServeHTTP(proto, s.HttpListen)
+		}()
+	}
+	if s.ApiListen != "" {
+		listeners++
+		go func() {
+			errCh <- s.serveApi()
+		}()
+	}
+	for i := 0; i < listeners; i++ {
+		if err := <-errCh; err != nil {
+			return fmt.Errorf("failed to start gosocks5 server: %v", err)
+		}
+	}
+	return nil
+}
+
+// serveApi serves the http api until the service context is done:
+// /metrics exports the prometheus metrics, /traffic exports the traffic accounting
+func (s *Service) serveApi() error {
+	mux := http.NewServeMux()
+	if s.Metrics != nil {
+		mux.Handle("/metrics", s.Metrics.Handler())
+	}
+	if s.Accounting != nil {
+		mux.Handle("/traffic", s.Accounting.Handler())
+	}
+	srv := &http.Server{Addr: s.ApiListen, Handler: mux, ReadHeaderTimeout: apiTimeout}
+	go func() {
+		<-s.Ctx.Done()
+		_ = srv.Close()
+	}()
+	s.Lg.Lg.Info().Msgf("start http api listener on %v", s.ApiListen)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("failed to serve http api: %v", err)
 	}
 	return nil
 }
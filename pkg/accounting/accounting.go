@@ -0,0 +1,319 @@
+package accounting
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/dossif/gosocks5/pkg/logger"
+	"github.com/dossif/gosocks5/pkg/socks5"
+	bolt "go.etcd.io/bbolt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultInterval      = time.Hour
+	DefaultFlushInterval = time.Second * 30
+	openTimeout          = time.Second
+)
+
+var trafficBucket = []byte("traffic")
+
+// Usage is the traffic of a user to a destination in an interval
+type Usage struct {
+	// Interval is the start of the aggregation interval
+	Interval time.Time `json:"interval"`
+	User     string    `json:"user"`
+	Dest     string    `json:"dest"`
+	// Up is the bytes sent by the user to the destination
+	Up int64 `json:"up"`
+	// Down is the bytes sent by the destination to the user
+	Down int64 `json:"down"`
+	// Sessions is the number of finished sessions
+	Sessions int64 `json:"sessions"`
+}
+
+// Filter selects usage records of the intervals starting in [From, To),
+// zero values match everything
+type Filter struct {
+	From time.Time
+	To   time.Time
+	User string
+}
+
+type usageKey struct {
+	interval int64
+	user     string
+	dest     string
+}
+
+// Accountant aggregates the relayed traffic per user and destination over fixed
+// intervals and persists the totals in a bolt database file, so they survive restarts.
+// Sessions are accounted in the interval they end in. Totals are kept in memory
+// and added to the database every flush interval.
+type Accountant struct {
+	Log *logger.Logger
+	// Interval is the aggregation interval, intervals are aligned to UTC
+	Interval time.Duration
+
+	db       *bolt.DB
+	mu       sync.Mutex
+	pending  map[usageKey]*Usage
+	readOnly bool
+	close    sync.Once
+}
+
+// NewAccountant opens the database and flushes the totals to it until ctx is done
+func NewAccountant(ctx context.Context, log *logger.Logger, path string, interval, flush time.Duration) (*Accountant, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: openTimeout})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %v: %v", path, err)
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(trafficBucket)
+		return err
+	}); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("failed to init %v: %v", path, err)
+	}
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+	if flush <= 0 {
+		flush = DefaultFlushInterval
+	}
+	a := &Accountant{
+		Log:      log,
+		Interval: interval,
+		db:       db,
+		pending:  make(map[usageKey]*Usage),
+	}
+	go a.run(ctx, flush)
+	return a, nil
+}
+
+// Open opens the database read-only, e.g. to export it with the server stopped.
+// The database is locked by a running server.
+func Open(path string) (*Accountant, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: openTimeout, ReadOnly: true})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %v: %v", path, err)
+	}
+	return &Accountant{db: db, pending: make(map[usageKey]*Usage), readOnly: true}, nil
+}
+
+// RecordTraffic adds the session traffic to the totals, implements socks5.TrafficRecorder
+func (a *Accountant) RecordTraffic(t socks5.Traffic) {
+	k := usageKey{
+		interval: t.End.Truncate(a.Interval).Unix(),
+		user:     t.User,
+		dest:     t.Dest,
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	u, found := a.pending[k]
+	if !found {
+		u = &Usage{Interval: time.Unix(k.interval, 0).UTC(), User: k.user, Dest: k.dest}
+		a.pending[k] = u
+	}
+	u.Up += t.Up
+	u.Down += t.Down
+	u.Sessions++
+}
+
+func (a *Accountant) run(ctx context.Context, flush time.Duration) {
+	ticker := time.NewTicker(flush)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := a.Flush(); err != nil {
+				a.Log.Lg.Warn().Msgf("failed to flush traffic accounting: %v", err)
+			}
+		}
+	}
+}
+
+// Flush adds the totals kept in memory to the database
+func (a *Accountant) Flush() error {
+	a.mu.Lock()
+	pending := a.pending
+	a.pending = make(map[usageKey]*Usage)
+	a.mu.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+	err := a.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(trafficBucket)
+		for k, u := range pending {
+			key := encodeKey(k)
+			total := *u
+			if v := b.Get(key); v != nil {
+				stored := decodeUsage(k, v)
+				total.Up += stored.Up
+				total.Down += stored.Down
+				total.Sessions += stored.Sessions
+			}
+			if err := b.Put(key, encodeUsage(total)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		// Keep the totals for the next flush
+		a.mu.Lock()
+		for k, u := range pending {
+			a.merge(k, u)
+		}
+		a.mu.Unlock()
+	}
+	return err
+}
+
+// merge adds the usage to the pending totals, the lock must be held
+func (a *Accountant) merge(k usageKey, u *Usage) {
+	p, found := a.pending[k]
+	if !found {
+		a.pending[k] = u
+		return
+	}
+	p.Up += u.Up
+	p.Down += u.Down
+	p.Sessions += u.Sessions
+}
+
+// Usage returns the totals matching the filter including the ones not flushed yet,
+// ordered by interval, user and destination
+func (a *Accountant) Usage(f Filter) ([]Usage, error) {
+	totals := make(map[usageKey]*Usage)
+	err := a.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(trafficBucket)
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		start := make([]byte, 8)
+		if !f.From.IsZero() {
+			binary.BigEndian.PutUint64(start, uint64(f.From.Unix()))
+		}
+		for key, v := c.Seek(start); key != nil; key, v = c.Next() {
+			k, err := decodeKey(key)
+			if err != nil {
+				return err
+			}
+			if !f.To.IsZero() && k.interval >= f.To.Unix() {
+				break
+			}
+			if f.match(k) {
+				u := decodeUsage(k, v)
+				totals[k] = &u
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	a.mu.Lock()
+	for k, u := range a.pending {
+		if !f.match(k) {
+			continue
+		}
+		if t, found := totals[k]; found {
+			t.Up += u.Up
+			t.Down += u.Down
+			t.Sessions += u.Sessions
+		} else {
+			copied := *u
+			totals[k] = &copied
+		}
+	}
+	a.mu.Unlock()
+
+	usage := make([]Usage, 0, len(totals))
+	for _, u := range totals {
+		usage = append(usage, *u)
+	}
+	sort.Slice(usage, func(i, j int) bool {
+		if !usage[i].Interval.Equal(usage[j].Interval) {
+			return usage[i].Interval.Before(usage[j].Interval)
+		}
+		if usage[i].User != usage[j].User {
+			return usage[i].User < usage[j].User
+		}
+		return usage[i].Dest < usage[j].Dest
+	})
+	return usage, nil
+}
+
+// Close flushes the totals and closes the database
+func (a *Accountant) Close() error {
+	var err error
+	a.close.Do(func() {
+		if !a.readOnly {
+			err = a.Flush()
+		}
+		if cerr := a.db.Close(); err == nil {
+			err = cerr
+		}
+	})
+	return err
+}
+
+func (f Filter) match(k usageKey) bool {
+	if !f.From.IsZero() && k.interval < f.From.Unix() {
+		return false
+	}
+	if !f.To.IsZero() && k.interval >= f.To.Unix() {
+		return false
+	}
+	return f.User == "" || k.user == f.User
+}
+
+// encodeKey orders the records by interval: INTERVAL(8) ULEN(2) USER DEST
+func encodeKey(k usageKey) []byte {
+	key := make([]byte, 10, 10+len(k.user)+len(k.dest))
+	binary.BigEndian.PutUint64(key, uint64(k.interval))
+	binary.BigEndian.PutUint16(key[8:], uint16(len(k.user)))
+	key = append(key, k.user...)
+	return append(key, k.dest...)
+}
+
+func decodeKey(key []byte) (usageKey, error) {
+	if len(key) < 10 {
+		return usageKey{}, fmt.Errorf("malformed key %x", key)
+	}
+	n := int(binary.BigEndian.Uint16(key[8:]))
+	if len(key) < 10+n {
+		return usageKey{}, fmt.Errorf("malformed key %x", key)
+	}
+	return usageKey{
+		interval: int64(binary.BigEndian.Uint64(key)),
+		user:     string(key[10 : 10+n]),
+		dest:     string(key[10+n:]),
+	}, nil
+}
+
+// encodeUsage stores UP(8) DOWN(8) SESSIONS(8)
+func encodeUsage(u Usage) []byte {
+	v := make([]byte, 24)
+	binary.BigEndian.PutUint64(v, uint64(u.Up))
+	binary.BigEndian.PutUint64(v[8:], uint64(u.Down))
+	binary.BigEndian.PutUint64(v[16:], uint64(u.Sessions))
+	return v
+}
+
+func decodeUsage(k usageKey, v []byte) Usage {
+	u := Usage{Interval: time.Unix(k.interval, 0).UTC(), User: k.user, Dest: k.dest}
+	if len(v) >= 24 {
+		u.Up = int64(binary.BigEndian.Uint64(v))
+		u.Down = int64(binary.BigEndian.Uint64(v[8:]))
+		u.Sessions = int64(binary.BigEndian.Uint64(v[16:]))
+	}
+	return u
+}
@@ -0,0 +1,100 @@
+package accounting
+
+import (
+	"context"
+	"github.com/dossif/gosocks5/pkg/logger"
+	"github.com/dossif/gosocks5/pkg/socks5"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccountant_Persist(t *testing.T) {
+	lg, _ := logger.NewLogger("debug")
+	path := filepath.Join(t.TempDir(), "traffic.db")
+	day := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+
+	a, err := NewAccountant(context.Background(), lg, path, time.Hour, time.Hour)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	a.RecordTraffic(socks5.Traffic{User: "alice", Dest: "example.com:443", Up: 10, Down: 100, End: day.Add(10 * time.Minute)})
+	a.RecordTraffic(socks5.Traffic{User: "alice", Dest: "example.com:443", Up: 1, Down: 2, End: day.Add(50 * time.Minute)})
+	a.RecordTraffic(socks5.Traffic{User: "bob", Dest: "10.0.0.1:22", Up: 5, Down: 6, End: day.Add(70 * time.Minute)})
+	if err := a.Flush(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	// Not flushed yet, added to the stored total on read
+	a.RecordTraffic(socks5.Traffic{User: "alice", Dest: "example.com:443", Up: 100, Down: 1000, End: day.Add(20 * time.Minute)})
+
+	expected := []Usage{
+		{Interval: day, User: "alice", Dest: "example.com:443", Up: 111, Down: 1102, Sessions: 3},
+		{Interval: day.Add(time.Hour), User: "bob", Dest: "10.0.0.1:22", Up: 5, Down: 6, Sessions: 1},
+	}
+	usage, err := a.Usage(Filter{})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !reflect.DeepEqual(usage, expected) {
+		t.Fatalf("bad: %v", usage)
+	}
+	if err := a.Close(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Totals survive a restart
+	ro, err := Open(path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer ro.Close()
+	for _, tc := range []struct {
+		filter   Filter
+		expected []Usage
+	}{
+		{Filter{}, expected},
+		{Filter{User: "bob"}, expected[1:]},
+		{Filter{From: day.Add(time.Minute)}, expected[1:]},
+		{Filter{To: day.Add(time.Hour)}, expected[:1]},
+	} {
+		usage, err := ro.Usage(tc.filter)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if !reflect.DeepEqual(usage, tc.expected) {
+			t.Fatalf("%+v: bad: %v", tc.filter, usage)
+		}
+	}
+}
+
+func TestAccountant_Handler(t *testing.T) {
+	lg, _ := logger.NewLogger("debug")
+	a, err := NewAccountant(context.Background(), lg, filepath.Join(t.TempDir(), "traffic.db"), 24*time.Hour, time.Hour)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer a.Close()
+	a.RecordTraffic(socks5.Traffic{User: "alice", Dest: "example.com:443", Up: 10, Down: 100, End: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)})
+
+	w := httptest.NewRecorder()
+	a.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/traffic?from=2024-05-01&to=2024-05-02&format=csv", nil))
+	expected := "interval,user,dest,up,down,sessions\n2024-05-01T00:00:00Z,alice,example.com:443,10,100,1\n"
+	if body := w.Body.String(); body != expected {
+		t.Fatalf("bad: %q", body)
+	}
+
+	w = httptest.NewRecorder()
+	a.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/traffic?user=bob", nil))
+	if body := strings.TrimSpace(w.Body.String()); body != "[]" {
+		t.Fatalf("bad: %q", body)
+	}
+
+	w = httptest.NewRecorder()
+	a.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/traffic?from=yesterday", nil))
+	if w.Code != 400 {
+		t.Fatalf("bad: %v", w.Code)
+	}
+}
@@ -0,0 +1,121 @@
+package accounting
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Export writes the usage in the format: csv or json
+func Export(w io.Writer, format string, usage []Usage) error {
+	switch format {
+	case "csv":
+		return WriteCSV(w, usage)
+	case "json":
+		return WriteJSON(w, usage)
+	default:
+		return fmt.Errorf("unsupported export format %q, use csv or json", format)
+	}
+}
+
+// WriteCSV writes the usage with a header line
+func WriteCSV(w io.Writer, usage []Usage) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"interval", "user", "dest", "up", "down", "sessions"}); err != nil {
+		return err
+	}
+	for _, u := range usage {
+		if err := cw.Write([]string{
+			u.Interval.Format(time.RFC3339),
+			u.User,
+			u.Dest,
+			strconv.FormatInt(u.Up, 10),
+			strconv.FormatInt(u.Down, 10),
+			strconv.FormatInt(u.Sessions, 10),
+		}); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// WriteJSON writes the usage as a json array
+func WriteJSON(w io.Writer, usage []Usage) error {
+	if usage == nil {
+		usage = []Usage{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(usage)
+}
+
+// ParseTime parses a filter bound given as RFC 3339 time or as a UTC date 2006-01-02
+func ParseTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q, use RFC 3339 or 2006-01-02", value)
+	}
+	return t, nil
+}
+
+// ParseFilter reads a filter from the from, to and user query parameters
+func ParseFilter(from, to, user string) (Filter, error) {
+	f := Filter{User: user}
+	var err error
+	if f.From, err = ParseTime(from); err != nil {
+		return Filter{}, err
+	}
+	if f.To, err = ParseTime(to); err != nil {
+		return Filter{}, err
+	}
+	return f, nil
+}
+
+// Handler serves the usage, e.g. GET /traffic?from=2024-01-01&to=2024-02-01&user=alice&format=csv.
+// The format defaults to json.
+func (a *Accountant) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		q := r.URL.Query()
+		f, err := ParseFilter(q.Get("from"), q.Get("to"), q.Get("user"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		format := q.Get("format")
+		if format == "" {
+			format = "json"
+		}
+		if format != "csv" && format != "json" {
+			http.Error(w, fmt.Sprintf("unsupported format %q", format), http.StatusBadRequest)
+			return
+		}
+		usage, err := a.Usage(f)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if format == "csv" {
+			w.Header().Set("Content-Type", "text/csv")
+		} else {
+			w.Header().Set("Content-Type", "application/json")
+		}
+		if err := Export(w, format, usage); err != nil && a.Log != nil {
+			a.Log.Lg.Warn().Msgf("failed to export traffic accounting: %v", err)
+		}
+	})
+}
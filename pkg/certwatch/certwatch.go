@@ -0,0 +1,111 @@
+package certwatch
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"github.com/dossif/gosocks5/pkg/logger"
+	"os"
+	"sync"
+	"time"
+)
+
+const DefaultInterval = time.Second * 10
+
+// Watcher keeps a tls certificate loaded from files and reloads it
+// when the files change. Established tls sessions are not affected,
+// the new certificate is used for new handshakes only.
+type Watcher struct {
+	CertFile string
+	KeyFile  string
+	Log      *logger.Logger
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	certMod fileState
+	keyMod  fileState
+}
+
+type fileState struct {
+	modTime time.Time
+	size    int64
+}
+
+// NewWatcher loads the certificate and starts watching the files until ctx is done
+func NewWatcher(ctx context.Context, log *logger.Logger, certFile, keyFile string, interval time.Duration) (*Watcher, error) {
+	w := &Watcher{
+		CertFile: certFile,
+		KeyFile:  keyFile,
+		Log:      log,
+	}
+	if _, err := w.reload(); err != nil {
+		return nil, err
+	}
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+	go w.watch(ctx, interval)
+	return w, nil
+}
+
+// GetCertificate returns the current certificate, suitable for tls.Config.GetCertificate
+func (w *Watcher) GetCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.cert, nil
+}
+
+func (w *Watcher) watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			reloaded, err := w.reload()
+			if err != nil {
+				w.Log.Lg.Warn().Msgf("failed to reload tls certificate, keep the previous one: %v", err)
+			} else if reloaded {
+				w.Log.Lg.Info().Msgf("tls certificate %v reloaded", w.CertFile)
+			}
+		}
+	}
+}
+
+// reload loads the certificate if the files changed since the last load
+func (w *Watcher) reload() (bool, error) {
+	certMod, err := stat(w.CertFile)
+	if err != nil {
+		return false, err
+	}
+	keyMod, err := stat(w.KeyFile)
+	if err != nil {
+		return false, err
+	}
+	w.mu.RLock()
+	changed := w.cert == nil || certMod != w.certMod || keyMod != w.keyMod
+	w.mu.RUnlock()
+	if !changed {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(w.CertFile, w.KeyFile)
+	if err != nil {
+		return false, fmt.Errorf("failed to load tls certificate %v: %v", w.CertFile, err)
+	}
+	w.mu.Lock()
+	w.cert = &cert
+	w.certMod = certMod
+	w.keyMod = keyMod
+	w.mu.Unlock()
+	return true, nil
+}
+
+func stat(file string) (fileState, error) {
+	fi, err := os.Stat(file)
+	if err != nil {
+		return fileState{}, err
+	}
+	return fileState{modTime: fi.ModTime(), size: fi.Size()}, nil
+}
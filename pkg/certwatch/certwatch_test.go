@@ -0,0 +1,101 @@
+package certwatch
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/dossif/gosocks5/pkg/logger"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeCert(t *testing.T, certFile, keyFile, cn string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{cn},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func leafCN(t *testing.T, cert *tls.Certificate) string {
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return leaf.Subject.CommonName
+}
+
+func TestWatcher_Reload(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "tls.crt")
+	keyFile := filepath.Join(dir, "tls.key")
+	writeCert(t, certFile, keyFile, "first")
+
+	lg, _ := logger.NewLogger("debug")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w, err := NewWatcher(ctx, lg, certFile, keyFile, 10*time.Millisecond)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	cert, _ := w.GetCertificate(nil)
+	if cn := leafCN(t, cert); cn != "first" {
+		t.Fatalf("bad: %v", cn)
+	}
+
+	// A broken file keeps the previous certificate
+	if err := os.WriteFile(certFile, []byte("broken"), 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	cert, _ = w.GetCertificate(nil)
+	if cn := leafCN(t, cert); cn != "first" {
+		t.Fatalf("bad: %v", cn)
+	}
+
+	writeCert(t, certFile, keyFile, "second")
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		cert, _ = w.GetCertificate(nil)
+		if leafCN(t, cert) == "second" {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("certificate was not reloaded")
+}
+
+func TestNewWatcher_MissingFile(t *testing.T) {
+	lg, _ := logger.NewLogger("debug")
+	if _, err := NewWatcher(context.Background(), lg, "/nonexistent.crt", "/nonexistent.key", 0); err == nil {
+		t.Fatalf("expected error")
+	}
+}
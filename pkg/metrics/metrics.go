@@ -0,0 +1,187 @@
+package metrics
+
+import (
+	"github.com/dossif/gosocks5/pkg/socks5"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const namespace = "gosocks5"
+
+// authMethods are the label values of the auth method codes
+var authMethods = map[uint8]string{
+	socks5.NoAuth:       "noauth",
+	socks5.UserPassAuth: "userpass",
+	socks5.TokenAuth:    "token",
+	socks5.NoAcceptable: "no_acceptable",
+}
+
+// replies are the label values of the reply codes
+var replies = map[uint8]string{
+	socks5.SuccessReply:         "succeeded",
+	socks5.ServerFailure:        "server_failure",
+	socks5.RuleFailure:          "not_allowed",
+	socks5.NetworkUnreachable:   "network_unreachable",
+	socks5.HostUnreachable:      "host_unreachable",
+	socks5.ConnectionRefused:    "connection_refused",
+	socks5.TTLExpired:           "ttl_expired",
+	socks5.CommandNotSupported:  "command_not_supported",
+	socks5.AddrTypeNotSupported: "address_type_not_supported",
+}
+
+// Metrics collects the server metrics in a prometheus registry, implements socks5.Metrics.
+// The registry includes the go runtime and process metrics.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	connsActive   *prometheus.GaugeVec
+	connsTotal    *prometheus.CounterVec
+	authAttempts  *prometheus.CounterVec
+	replies       *prometheus.CounterVec
+	resolveTime   prometheus.Histogram
+	resolveErrors prometheus.Counter
+	dialTime      *prometheus.HistogramVec
+	relayed       *prometheus.CounterVec
+	ruleDecisions *prometheus.CounterVec
+
+	// relayedUp and relayedDown are the relayed counters, cached as they are hot
+	relayedUp   prometheus.Counter
+	relayedDown prometheus.Counter
+}
+
+var _ socks5.Metrics = (*Metrics)(nil)
+
+// New creates the metrics
+func New() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		connsActive: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "connections_active",
+			Help:      "Active client connections per listener.",
+		}, []string{"listener"}),
+		connsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "connections_total",
+			Help:      "Accepted client connections per listener, http proxy requests for http listeners.",
+		}, []string{"listener"}),
+		authAttempts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "auth_attempts_total",
+			Help:      "Authentication attempts per auth method and result.",
+		}, []string{"method", "result"}),
+		replies: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "replies_total",
+			Help:      "Replies sent to requests per reply code.",
+		}, []string{"reply"}),
+		resolveTime: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "resolve_duration_seconds",
+			Help:      "Latency of destination name lookups.",
+			Buckets:   prometheus.ExponentialBuckets(0.001, 2, 14),
+		}),
+		resolveErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "resolve_errors_total",
+			Help:      "Failed destination name lookups.",
+		}),
+		dialTime: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "dial_duration_seconds",
+			Help:      "Latency of destination dials including all attempts per result.",
+			Buckets:   prometheus.ExponentialBuckets(0.001, 2, 15),
+		}, []string{"result"}),
+		relayed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "relayed_bytes_total",
+			Help:      "Bytes relayed up to or down from destinations.",
+		}, []string{"direction"}),
+		ruleDecisions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "rule_decisions_total",
+			Help:      "Rule evaluations per request phase and decision.",
+		}, []string{"phase", "decision"}),
+	}
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.connsActive,
+		m.connsTotal,
+		m.authAttempts,
+		m.replies,
+		m.resolveTime,
+		m.resolveErrors,
+		m.dialTime,
+		m.relayed,
+		m.ruleDecisions,
+	)
+	m.relayedUp = m.relayed.WithLabelValues("up")
+	m.relayedDown = m.relayed.WithLabelValues("down")
+	return m
+}
+
+// Handler serves the metrics in the prometheus text format
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+func (m *Metrics) ConnOpened(listener string) {
+	m.connsActive.WithLabelValues(listener).Inc()
+	m.connsTotal.WithLabelValues(listener).Inc()
+}
+
+func (m *Metrics) ConnClosed(listener string) {
+	m.connsActive.WithLabelValues(listener).Dec()
+}
+
+func (m *Metrics) AuthResult(method uint8, ok bool) {
+	m.authAttempts.WithLabelValues(codeLabel(authMethods, method), result(ok, "success", "failure")).Inc()
+}
+
+func (m *Metrics) Reply(code uint8) {
+	m.replies.WithLabelValues(codeLabel(replies, code)).Inc()
+}
+
+func (m *Metrics) Resolved(d time.Duration, err error) {
+	m.resolveTime.Observe(d.Seconds())
+	if err != nil {
+		m.resolveErrors.Inc()
+	}
+}
+
+func (m *Metrics) Dialed(d time.Duration, err error) {
+	m.dialTime.WithLabelValues(result(err == nil, "success", "failure")).Observe(d.Seconds())
+}
+
+func (m *Metrics) Relayed(up, down int64) {
+	if up > 0 {
+		m.relayedUp.Add(float64(up))
+	}
+	if down > 0 {
+		m.relayedDown.Add(float64(down))
+	}
+}
+
+func (m *Metrics) RuleDecision(phase socks5.RulePhase, allowed bool) {
+	m.ruleDecisions.WithLabelValues(phase.String(), result(allowed, "allow", "deny")).Inc()
+}
+
+// codeLabel returns the label value of a protocol code, unknown codes are numeric
+func codeLabel(names map[uint8]string, code uint8) string {
+	if name, ok := names[code]; ok {
+		return name
+	}
+	return strconv.Itoa(int(code))
+}
+
+func result(ok bool, success, failure string) string {
+	if ok {
+		return success
+	}
+	return failure
+}
@@ -0,0 +1,52 @@
+package metrics
+
+import (
+	"errors"
+	"github.com/dossif/gosocks5/pkg/socks5"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics_Handler(t *testing.T) {
+	m := New()
+	m.ConnOpened("0.0.0.0:1080")
+	m.ConnOpened("0.0.0.0:1080")
+	m.ConnClosed("0.0.0.0:1080")
+	m.AuthResult(socks5.UserPassAuth, true)
+	m.AuthResult(socks5.NoAcceptable, false)
+	m.Reply(socks5.SuccessReply)
+	m.Reply(socks5.HostUnreachable)
+	m.Reply(42)
+	m.Resolved(time.Millisecond, errors.New("nxdomain"))
+	m.Dialed(time.Millisecond, nil)
+	m.Relayed(10, 0)
+	m.Relayed(5, 100)
+	m.RuleDecision(socks5.PostResolve, false)
+
+	rec := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := io.ReadAll(rec.Body)
+	for _, line := range []string{
+		`gosocks5_connections_active{listener="0.0.0.0:1080"} 1`,
+		`gosocks5_connections_total{listener="0.0.0.0:1080"} 2`,
+		`gosocks5_auth_attempts_total{method="userpass",result="success"} 1`,
+		`gosocks5_auth_attempts_total{method="no_acceptable",result="failure"} 1`,
+		`gosocks5_replies_total{reply="succeeded"} 1`,
+		`gosocks5_replies_total{reply="host_unreachable"} 1`,
+		`gosocks5_replies_total{reply="42"} 1`,
+		`gosocks5_resolve_errors_total 1`,
+		`gosocks5_resolve_duration_seconds_count 1`,
+		`gosocks5_dial_duration_seconds_count{result="success"} 1`,
+		`gosocks5_relayed_bytes_total{direction="up"} 15`,
+		`gosocks5_relayed_bytes_total{direction="down"} 100`,
+		`gosocks5_rule_decisions_total{decision="deny",phase="post-resolve"} 1`,
+		`go_goroutines`,
+	} {
+		if !strings.Contains(string(body), line) {
+			t.Errorf("missing %v", line)
+		}
+	}
+}
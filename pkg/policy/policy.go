@@ -0,0 +1,407 @@
+package policy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/dossif/gosocks5/pkg/socks5"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	Allow = "allow"
+	Deny  = "deny"
+
+	ResolveLocal  = "local"
+	ResolveRemote = "remote"
+)
+
+var (
+	_ socks5.RuleSet       = (*Policy)(nil)
+	_ socks5.ResolvePolicy = (*Policy)(nil)
+)
+
+// Policy is a socks5.RuleSet of ordered allow and deny rules.
+// The first matching rule decides, requests matching no rule get the default action.
+//
+// Example:
+//
+//	default: deny
+//	rules:
+//	  - log: devops-ssh
+//	    action: allow
+//	    payload:
+//	      OU: [devops]
+//	    destinations: [10.0.0.0/8]
+//	    ports: ["22"]
+//	  - log: web
+//	    action: allow
+//	    domains: ["*.example.com", .corp.internal]
+//	    ports: ["80", "443", "8000-8999"]
+//	    commands: [connect]
+//	  - log: onion
+//	    action: allow
+//	    domains: [.onion]
+//	    resolve: remote
+type Policy struct {
+	Default string  `yaml:"default"`
+	Rules   []*Rule `yaml:"rules"`
+}
+
+// Rule matches when all the given fields match, a field matches
+// when any of its values does. Empty fields match everything.
+type Rule struct {
+	// Log is the tag logged when the rule decides
+	Log string `yaml:"log"`
+	// Action is allow or deny
+	Action string `yaml:"action"`
+	// Users match the authenticated username
+	Users []string `yaml:"users"`
+	// Payload matches AuthContext.Payload fields, comma separated
+	// payload values also match if any element does
+	Payload map[string][]string `yaml:"payload"`
+	// Sources are client CIDRs
+	Sources []string `yaml:"sources"`
+	// Destinations are destination CIDRs
+	Destinations []string `yaml:"destinations"`
+	// Domains are destination names: exact, glob with "*" or suffix with a leading "."
+	Domains []string `yaml:"domains"`
+	// Ports are destination ports or ranges: "443", "8000-8999"
+	Ports []string `yaml:"ports"`
+	// Resolve is remote to pass the destination names of matching connect requests
+	// to the upstream unresolved, local by default. See Policy.RemoteResolve.
+	Resolve string `yaml:"resolve"`
+	// Commands are connect, bind or associate. The destination fields of associate
+	// rules are checked for every udp datagram destination, the associate request
+	// itself matches allow rules regardless of them and no deny rule with them.
+	Commands []string `yaml:"commands"`
+
+	sources      []*net.IPNet
+	destinations []*net.IPNet
+	ports        [][2]int
+	commands     []uint8
+}
+
+var commands = map[string]uint8{
+	"connect":   socks5.ConnectCommand,
+	"bind":      socks5.BindCommand,
+	"associate": socks5.AssociateCommand,
+}
+
+// Load reads and validates the policy file
+func Load(file string) (*Policy, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read policy: %v", err)
+	}
+	p, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid policy %v: %v", file, err)
+	}
+	return p, nil
+}
+
+// Parse decodes and validates the policy. Unknown fields are rejected.
+func Parse(data []byte) (*Policy, error) {
+	p := &Policy{}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(p); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	if p.Default == "" {
+		p.Default = Deny
+	}
+	if p.Default != Allow && p.Default != Deny {
+		return nil, fmt.Errorf("default: unsupported action %q", p.Default)
+	}
+	for i, r := range p.Rules {
+		if err := r.compile(); err != nil {
+			return nil, fmt.Errorf("rule %v (%v): %v", i+1, r.Log, err)
+		}
+	}
+	return p, nil
+}
+
+func (r *Rule) compile() error {
+	if r.Action != Allow && r.Action != Deny {
+		return fmt.Errorf("unsupported action %q, expected allow or deny", r.Action)
+	}
+	for _, c := range r.Sources {
+		n, err := parseCIDR(c)
+		if err != nil {
+			return fmt.Errorf("sources: %v", err)
+		}
+		r.sources = append(r.sources, n)
+	}
+	for _, c := range r.Destinations {
+		n, err := parseCIDR(c)
+		if err != nil {
+			return fmt.Errorf("destinations: %v", err)
+		}
+		r.destinations = append(r.destinations, n)
+	}
+	for _, d := range r.Domains {
+		if _, err := path.Match(strings.ToLower(d), ""); err != nil {
+			return fmt.Errorf("domains: invalid pattern %q", d)
+		}
+	}
+	for _, p := range r.Ports {
+		ports, err := parsePorts(p)
+		if err != nil {
+			return fmt.Errorf("ports: %v", err)
+		}
+		r.ports = append(r.ports, ports)
+	}
+	for _, c := range r.Commands {
+		cmd, ok := commands[strings.ToLower(c)]
+		if !ok {
+			return fmt.Errorf("commands: unsupported command %q, expected connect, bind or associate", c)
+		}
+		r.commands = append(r.commands, cmd)
+	}
+	switch r.Resolve {
+	case "", ResolveLocal:
+	case ResolveRemote:
+		if r.Action != Allow {
+			return fmt.Errorf("resolve: remote requires the allow action")
+		}
+		if len(r.destinations) > 0 {
+			return fmt.Errorf("resolve: remote can not be used with destinations")
+		}
+		if len(r.commands) > 0 && !containsCommand(r.commands, socks5.ConnectCommand) {
+			return fmt.Errorf("resolve: remote requires the connect command")
+		}
+	default:
+		return fmt.Errorf("resolve: unsupported mode %q, expected local or remote", r.Resolve)
+	}
+	return nil
+}
+
+// parseCIDR also accepts a single ip
+func parseCIDR(s string) (*net.IPNet, error) {
+	if ip := net.ParseIP(s); ip != nil {
+		bits := 8 * len(ip.To16())
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 32
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cidr %q", s)
+	}
+	return n, nil
+}
+
+func parsePorts(s string) ([2]int, error) {
+	from, to, isRange := strings.Cut(s, "-")
+	if !isRange {
+		to = from
+	}
+	min, err1 := strconv.Atoi(strings.TrimSpace(from))
+	max, err2 := strconv.Atoi(strings.TrimSpace(to))
+	if err1 != nil || err2 != nil || min < 0 || max > 0xffff || min > max {
+		return [2]int{}, fmt.Errorf("invalid port range %q", s)
+	}
+	return [2]int{min, max}, nil
+}
+
+// Allow returns the action of the first matching rule or the default one.
+// Before resolution deny rules with destination cidrs are skipped and the decision is
+// deferred to the next phases at the first allow rule with them, the final phase
+// matches the rewritten destination.
+// Destinations resolved remotely have no ip at the final phase, so deny rules
+// with destination cidrs match them.
+func (p *Policy) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	dest := req.DestAddr
+	if req.Phase == socks5.Final && req.RealDestAddr() != nil {
+		dest = req.RealDestAddr()
+	}
+	for _, r := range p.Rules {
+		// Before resolution rules with destination cidrs can't be evaluated yet. Skipped deny rules
+		// are checked after resolution, a skipped allow rule may win over any later rule.
+		if req.Phase == socks5.PreResolve && len(r.destinations) > 0 && dest != nil && dest.IP == nil {
+			if r.Action == Allow {
+				return ctx, true
+			}
+			continue
+		}
+		if r.match(req, dest) {
+			p.log(req, r.Log, r.Action, dest)
+			return ctx, r.Action == Allow
+		}
+	}
+	p.log(req, "default", p.Default, dest)
+	return ctx, p.Default == Allow
+}
+
+// RemoteResolve reports whether the first rule matching the requested destination
+// resolves it remotely. Rules with destination cidrs are skipped, the ip is unknown.
+func (p *Policy) RemoteResolve(_ context.Context, req *socks5.Request) bool {
+	for _, r := range p.Rules {
+		if len(r.destinations) > 0 {
+			continue
+		}
+		if r.match(req, req.DestAddr) {
+			return r.Resolve == ResolveRemote
+		}
+	}
+	return false
+}
+
+// HasRemoteResolve reports whether any rule resolves destinations remotely
+func (p *Policy) HasRemoteResolve() bool {
+	for _, r := range p.Rules {
+		if r.Resolve == ResolveRemote {
+			return true
+		}
+	}
+	return false
+}
+
+// log reports denials and final decisions, other phases are logged in debug
+func (p *Policy) log(req *socks5.Request, tag, action string, dest *socks5.AddrSpec) {
+	if req.Lg == nil {
+		return
+	}
+	if action == Deny || req.Phase == socks5.Final {
+		req.Lg.Lg.Info().Msgf("policy rule %v: %v %v", tag, action, dest)
+	} else {
+		req.Lg.Lg.Debug().Msgf("policy rule %v: %v %v (%v)", tag, action, dest, req.Phase)
+	}
+}
+
+func (r *Rule) match(req *socks5.Request, dest *socks5.AddrSpec) bool {
+	var payload map[string]string
+	if req.AuthContext != nil {
+		payload = req.AuthContext.Payload
+	}
+	if len(r.Users) > 0 && !contains(r.Users, payload["Username"]) {
+		return false
+	}
+	for key, values := range r.Payload {
+		if !payloadMatch(values, payload[key]) {
+			return false
+		}
+	}
+	if len(r.commands) > 0 && !containsCommand(r.commands, req.Command) {
+		return false
+	}
+	if len(r.sources) > 0 && (req.RemoteAddr == nil || !cidrMatch(r.sources, req.RemoteAddr.IP)) {
+		return false
+	}
+	// The associate request carries the client address, destinations are checked per datagram
+	if req.Command == socks5.AssociateCommand && !req.Datagram && r.hasDestination() {
+		return r.Action == Allow
+	}
+	if dest == nil {
+		return !r.hasDestination()
+	}
+	if len(r.destinations) > 0 {
+		// Remotely resolved destinations have no ip, deny rules fail closed
+		if dest.IP == nil {
+			if r.Action != Deny {
+				return false
+			}
+		} else if !cidrMatch(r.destinations, dest.IP) {
+			return false
+		}
+	}
+	if len(r.Domains) > 0 && !domainMatch(r.Domains, dest.FQDN) {
+		return false
+	}
+	if len(r.ports) > 0 && !portMatch(r.ports, dest.Port) {
+		return false
+	}
+	return true
+}
+
+func contains(values []string, v string) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
+
+// hasDestination reports whether the rule matches destinations
+func (r *Rule) hasDestination() bool {
+	return len(r.destinations) > 0 || len(r.Domains) > 0 || len(r.ports) > 0
+}
+
+func containsCommand(commands []uint8, c uint8) bool {
+	for _, cmd := range commands {
+		if cmd == c {
+			return true
+		}
+	}
+	return false
+}
+
+func payloadMatch(values []string, payload string) bool {
+	if contains(values, payload) {
+		return true
+	}
+	for _, p := range strings.Split(payload, ",") {
+		if contains(values, strings.TrimSpace(p)) {
+			return true
+		}
+	}
+	return false
+}
+
+func cidrMatch(nets []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// domainMatch matches exact names, globs and suffixes with a leading dot,
+// the suffix matches the domain itself too
+func domainMatch(patterns []string, fqdn string) bool {
+	if fqdn == "" {
+		return false
+	}
+	fqdn = strings.TrimSuffix(strings.ToLower(fqdn), ".")
+	for _, p := range patterns {
+		p = strings.ToLower(p)
+		switch {
+		case strings.HasPrefix(p, "."):
+			if strings.HasSuffix(fqdn, p) || fqdn == p[1:] {
+				return true
+			}
+		case strings.Contains(p, "*"):
+			if ok, _ := path.Match(p, fqdn); ok {
+				return true
+			}
+		case p == fqdn:
+			return true
+		}
+	}
+	return false
+}
+
+func portMatch(ranges [][2]int, port int) bool {
+	for _, r := range ranges {
+		if port >= r[0] && port <= r[1] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,418 @@
+package policy
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dossif/gosocks5/pkg/logger"
+	"github.com/dossif/gosocks5/pkg/socks5"
+	"github.com/dossif/gosocks5/pkg/socks5/client"
+)
+
+const testPolicy = `
+default: deny
+rules:
+  - log: blocked-admin
+    action: deny
+    domains: [admin.corp.internal]
+  - log: devops-ssh
+    action: allow
+    payload:
+      OU: [devops]
+    destinations: [10.0.0.0/8]
+    ports: ["22"]
+  - log: office-web
+    action: allow
+    users: [alice, bob]
+    sources: [192.168.1.0/24, 192.168.2.10]
+    domains: ["*.example.com", .corp.internal]
+    ports: ["80", "443", "8000-8999"]
+    commands: [connect]
+`
+
+func request(user, ou, src string, cmd uint8, fqdn, ip string, port int) *socks5.Request {
+	return &socks5.Request{
+		Command:     cmd,
+		AuthContext: &socks5.AuthContext{Method: socks5.UserPassAuth, Payload: map[string]string{"Username": user, "OU": ou}},
+		RemoteAddr:  &socks5.AddrSpec{IP: net.ParseIP(src), Port: 50000},
+		DestAddr:    &socks5.AddrSpec{FQDN: fqdn, IP: net.ParseIP(ip), Port: port},
+	}
+}
+
+func TestPolicy_Allow(t *testing.T) {
+	p, err := Parse([]byte(testPolicy))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		req      *socks5.Request
+		expected bool
+	}{
+		{"web", request("alice", "", "192.168.1.5", socks5.ConnectCommand, "www.example.com", "192.0.2.1", 443), true},
+		{"web range", request("bob", "", "192.168.2.10", socks5.ConnectCommand, "git.corp.internal", "10.1.1.1", 8080), true},
+		{"web suffix itself", request("bob", "", "192.168.2.10", socks5.ConnectCommand, "corp.internal", "10.1.1.1", 80), true},
+		{"web unknown user", request("eve", "", "192.168.1.5", socks5.ConnectCommand, "www.example.com", "192.0.2.1", 443), false},
+		{"web wrong source", request("alice", "", "192.168.2.11", socks5.ConnectCommand, "www.example.com", "192.0.2.1", 443), false},
+		{"web wrong port", request("alice", "", "192.168.1.5", socks5.ConnectCommand, "www.example.com", "192.0.2.1", 22), false},
+		{"web wrong command", request("alice", "", "192.168.1.5", socks5.BindCommand, "www.example.com", "192.0.2.1", 443), false},
+		{"web bare domain", request("alice", "", "192.168.1.5", socks5.ConnectCommand, "example.com", "192.0.2.1", 443), false},
+		{"denied first", request("alice", "devops", "192.168.1.5", socks5.ConnectCommand, "ADMIN.corp.internal.", "10.0.0.1", 22), false},
+		{"ssh", request("carol", "build,devops", "172.16.0.1", socks5.ConnectCommand, "", "10.2.3.4", 22), true},
+		{"ssh other group", request("carol", "build", "172.16.0.1", socks5.ConnectCommand, "", "10.2.3.4", 22), false},
+		{"ssh outside", request("carol", "devops", "172.16.0.1", socks5.ConnectCommand, "", "192.0.2.1", 22), false},
+	} {
+		if _, ok := p.Allow(context.Background(), tc.req); ok != tc.expected {
+			t.Errorf("%v: bad: %v", tc.name, ok)
+		}
+	}
+}
+
+func TestParse_Errors(t *testing.T) {
+	for _, tc := range []struct {
+		policy   string
+		expected string
+	}{
+		{"default: maybe", `default: unsupported action "maybe"`},
+		{"rules:\n  - action: permit", `rule 1 (): unsupported action "permit"`},
+		{"rules:\n  - log: a\n    action: allow\n    sources: [10.0.0.0/33]", `rule 1 (a): sources: invalid cidr "10.0.0.0/33"`},
+		{"rules:\n  - log: a\n    action: allow\n    ports: [\"90-80\"]", `rule 1 (a): ports: invalid port range "90-80"`},
+		{"rules:\n  - log: a\n    action: allow\n    commands: [udp]", `rule 1 (a): commands: unsupported command "udp"`},
+		{"rules:\n  - log: a\n    action: allow\n    domains: [\"[a\"]", `rule 1 (a): domains: invalid pattern "[a"`},
+		{"rules:\n  - log: a\n    action: allow\n    port: [\"80\"]", `field port not found`},
+		{"rules:\n  - log: a\n    action: allow\n    resolve: upstream", `rule 1 (a): resolve: unsupported mode "upstream"`},
+		{"rules:\n  - log: a\n    action: deny\n    resolve: remote", `rule 1 (a): resolve: remote requires the allow action`},
+		{"rules:\n  - log: a\n    action: allow\n    destinations: [10.0.0.0/8]\n    resolve: remote", `rule 1 (a): resolve: remote can not be used with destinations`},
+		{"rules:\n  - log: a\n    action: allow\n    commands: [bind]\n    resolve: remote", `rule 1 (a): resolve: remote requires the connect command`},
+	} {
+		_, err := Parse([]byte(tc.policy))
+		if err == nil || !strings.Contains(err.Error(), tc.expected) {
+			t.Errorf("%q: bad: %v", tc.policy, err)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "policy.yaml")
+	if err := os.WriteFile(file, []byte("default: allow\n"), 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	p, err := Load(file)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, ok := p.Allow(context.Background(), &socks5.Request{}); !ok {
+		t.Fatalf("expected allow")
+	}
+	if _, err := Load(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestPolicy_Phases(t *testing.T) {
+	p, err := Parse([]byte(`
+rules:
+  - log: admin
+    action: deny
+    domains: [admin.example.com]
+  - log: ssrf
+    action: deny
+    destinations: [10.0.0.0/8, 127.0.0.0/8]
+  - log: example
+    action: allow
+    domains: [.example.com]
+`))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		phase    socks5.RulePhase
+		fqdn     string
+		ip       string
+		expected bool
+	}{
+		{"blocked before lookup", socks5.PreResolve, "admin.example.com", "", false},
+		{"deferred to resolution", socks5.PreResolve, "www.example.com", "", true},
+		{"unknown domain denied before lookup", socks5.PreResolve, "www.example.org", "", false},
+		{"rebinding", socks5.PostResolve, "www.example.com", "10.1.1.1", false},
+		{"resolved", socks5.PostResolve, "www.example.com", "192.0.2.1", true},
+		{"unknown domain", socks5.PostResolve, "www.example.org", "192.0.2.1", false},
+		{"remote resolution fails closed", socks5.Final, "www.example.com", "", false},
+		{"resolved final", socks5.Final, "www.example.com", "192.0.2.1", true},
+	} {
+		req := request("alice", "", "192.168.1.5", socks5.ConnectCommand, tc.fqdn, tc.ip, 443)
+		req.Phase = tc.phase
+		if _, ok := p.Allow(context.Background(), req); ok != tc.expected {
+			t.Errorf("%v: bad: %v", tc.name, ok)
+		}
+	}
+}
+
+func TestPolicy_PreResolveSkipsCidrRules(t *testing.T) {
+	p, err := Parse([]byte(`
+default: allow
+rules:
+  - log: ssrf
+    action: deny
+    destinations: [10.0.0.0/8]
+  - log: admin
+    action: deny
+    domains: [admin.example.com]
+  - log: office
+    action: allow
+    destinations: [192.168.0.0/16]
+  - log: intranet
+    action: deny
+    domains: [intranet.example.com]
+`))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		fqdn     string
+		expected bool
+	}{
+		{"deny after a skipped deny rule", "admin.example.com", false},
+		{"deny after a skipped allow rule", "intranet.example.com", true},
+		{"no match", "www.example.com", true},
+	} {
+		req := request("alice", "", "192.168.1.5", socks5.ConnectCommand, tc.fqdn, "", 443)
+		req.Phase = socks5.PreResolve
+		if _, ok := p.Allow(context.Background(), req); ok != tc.expected {
+			t.Errorf("%v: bad: %v", tc.name, ok)
+		}
+	}
+}
+
+func TestPolicy_RemoteResolve(t *testing.T) {
+	p, err := Parse([]byte(`
+default: allow
+rules:
+  - log: ssrf
+    action: deny
+    users: [bob]
+    destinations: [10.0.0.0/8]
+  - log: trusted
+    action: allow
+    destinations: [192.0.2.0/24]
+`))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Without an ip a deny rule with destination cidrs matches, an allow rule does not
+	for user, expected := range map[string]bool{"alice": true, "bob": false} {
+		req := request(user, "", "192.168.1.5", socks5.ConnectCommand, "internal.example", "", 80)
+		req.Phase = socks5.Final
+		if _, ok := p.Allow(context.Background(), req); ok != expected {
+			t.Errorf("%v: bad: %v", user, ok)
+		}
+	}
+}
+
+func TestPolicy_ResolveRemote(t *testing.T) {
+	p, err := Parse([]byte(`
+default: allow
+rules:
+  - log: onion
+    action: allow
+    users: [alice]
+    domains: [.onion]
+    resolve: remote
+  - log: ssrf
+    action: deny
+    destinations: [10.0.0.0/8]
+  - log: local
+    action: allow
+    domains: [.example.com]
+    resolve: local
+`))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !p.HasRemoteResolve() {
+		t.Fatalf("expected remote resolve rules")
+	}
+
+	for _, tc := range []struct {
+		name     string
+		user     string
+		fqdn     string
+		expected bool
+	}{
+		{"remote rule", "alice", "abc.onion", true},
+		{"other user", "bob", "abc.onion", false},
+		{"cidr rule skipped", "alice", "www.example.com", false},
+		{"no match", "alice", "www.example.org", false},
+	} {
+		req := request(tc.user, "", "192.168.1.5", socks5.ConnectCommand, tc.fqdn, "", 443)
+		if remote := p.RemoteResolve(context.Background(), req); remote != tc.expected {
+			t.Errorf("%v: bad: %v", tc.name, remote)
+		}
+	}
+
+	// The remote rule decides before the deny rule fails closed without an ip
+	req := request("alice", "", "192.168.1.5", socks5.ConnectCommand, "abc.onion", "", 443)
+	req.Phase = socks5.Final
+	if _, ok := p.Allow(context.Background(), req); !ok {
+		t.Fatalf("expected allow")
+	}
+}
+
+// groupStore is an ldap-style store with user groups as attributes
+type groupStore map[string]string
+
+func (g groupStore) Valid(user, password string) bool {
+	_, ok := g[user]
+	return ok && password == "secret"
+}
+
+func (g groupStore) Attributes(user string) map[string]string {
+	return map[string]string{"Groups": g[user]}
+}
+
+// newServer serves socks5 with the policy and returns the listener address
+func newServer(t *testing.T, conf *socks5.Config) string {
+	lg, err := logger.NewLogger("debug")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	serv, err := socks5.New(ctx, lg, conf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	go func() {
+		_ = serv.ServeListener(l)
+	}()
+	return l.Addr().String()
+}
+
+func TestPolicy_PayloadGroups(t *testing.T) {
+	p, err := Parse([]byte(`
+default: deny
+rules:
+  - log: devops
+    action: allow
+    payload:
+      Groups: [devops]
+`))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	addr := newServer(t, &socks5.Config{
+		Credentials: groupStore{"alice": "Domain Users,devops", "bob": "Domain Users"},
+		Rules:       p,
+	})
+
+	for user, expected := range map[string]bool{"alice": true, "bob": false} {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		conn, err := client.NewDialer(addr, user, "secret").DialContext(ctx, "tcp", target.Addr().String())
+		cancel()
+		if err == nil {
+			conn.Close()
+		}
+		if (err == nil) != expected {
+			t.Errorf("%v: bad: %v", user, err)
+		}
+	}
+}
+
+func TestPolicy_Associate(t *testing.T) {
+	echo := func() *net.UDPConn {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		go func() {
+			buf := make([]byte, 1024)
+			for {
+				n, src, err := conn.ReadFromUDP(buf)
+				if err != nil {
+					return
+				}
+				_, _ = conn.WriteToUDP(buf[:n], src)
+			}
+		}()
+		return conn
+	}
+	allowed, denied := echo(), echo()
+	deniedPort := denied.LocalAddr().(*net.UDPAddr).Port
+
+	// The deny rule with a destination port must not refuse the associate request
+	p, err := Parse([]byte(`
+default: deny
+rules:
+  - log: blocked-port
+    action: deny
+    ports: ["` + strconv.Itoa(deniedPort) + `"]
+  - log: loopback-udp
+    action: allow
+    destinations: [127.0.0.0/8]
+    commands: [associate]
+`))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	addr := newServer(t, &socks5.Config{Rules: p})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	conn, err := client.NewDialer(addr, "", "").Associate(ctx)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+
+	for _, tc := range []struct {
+		target   *net.UDPConn
+		expected bool
+	}{
+		{denied, false},
+		{allowed, true},
+	} {
+		target := tc.target.LocalAddr().(*net.UDPAddr)
+		_ = conn.SetDeadline(time.Now().Add(200 * time.Millisecond))
+		if _, err := conn.WriteTo([]byte("ping"), &socks5.AddrSpec{IP: target.IP, Port: target.Port}); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		_, from, err := conn.ReadFrom(make([]byte, 16))
+		if (err == nil) != tc.expected {
+			t.Errorf("%v: bad: %v", target, err)
+		}
+		if err == nil && from.Port != target.Port {
+			t.Errorf("%v: bad source: %v", target, from)
+		}
+	}
+}
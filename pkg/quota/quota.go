@@ -0,0 +1,320 @@
+package quota
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/dossif/gosocks5/pkg/logger"
+	"github.com/dossif/gosocks5/pkg/socks5"
+	bolt "go.etcd.io/bbolt"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultFlushInterval = time.Second * 30
+	openTimeout          = time.Second
+)
+
+var usageBucket = []byte("usage")
+
+// Window is the period a data cap applies to
+type Window int
+
+const (
+	Daily Window = iota
+	Weekly
+	Monthly
+	windows
+)
+
+func (w Window) String() string {
+	switch w {
+	case Daily:
+		return "daily"
+	case Weekly:
+		return "weekly"
+	default:
+		return "monthly"
+	}
+}
+
+// Limits are data caps in bytes of up and down traffic together, 0 is unlimited
+type Limits [windows]int64
+
+// Schedule sets when the windows reset
+type Schedule struct {
+	// Hour of the day the windows start
+	Hour int
+	// Weekday the weekly window starts
+	Weekday time.Weekday
+	// Day of the month the monthly window starts, 1-28
+	Day int
+	// Location of the schedule, defaults to UTC
+	Location *time.Location
+}
+
+// Start returns the start of the window containing t
+func (s Schedule) Start(w Window, t time.Time) time.Time {
+	loc := s.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+	t = t.In(loc)
+	switch w {
+	case Monthly:
+		day := s.Day
+		if day < 1 {
+			day = 1
+		}
+		start := time.Date(t.Year(), t.Month(), day, s.Hour, 0, 0, 0, loc)
+		if start.After(t) {
+			start = start.AddDate(0, -1, 0)
+		}
+		return start
+	default:
+		start := time.Date(t.Year(), t.Month(), t.Day(), s.Hour, 0, 0, 0, loc)
+		if start.After(t) {
+			start = start.AddDate(0, 0, -1)
+		}
+		if w == Weekly {
+			start = start.AddDate(0, 0, -((int(start.Weekday()) - int(s.Weekday) + 7) % 7))
+		}
+		return start
+	}
+}
+
+// Config defines the data caps. The limits of a user are taken from Users,
+// then from the groups of the user, then Default.
+type Config struct {
+	Default Limits
+	Users   map[string]Limits
+	// Groups limits the members, a user in several groups gets the highest cap per window
+	Groups map[string]Limits
+	// UserGroups returns the groups of the user, e.g. from ldap
+	UserGroups func(user string) []string
+	Schedule   Schedule
+}
+
+// usage is the data used by a user in the current windows
+type usage struct {
+	start [windows]int64
+	used  [windows]int64
+}
+
+// Manager enforces the data caps, implements socks5.DataQuota.
+// The usage is kept in memory and saved to a bolt database file every flush interval,
+// so it survives restarts.
+type Manager struct {
+	Log  *logger.Logger
+	conf Config
+	db   *bolt.DB
+
+	mu    sync.Mutex
+	users map[string]*usage
+	dirty map[string]bool
+	now   func() time.Time
+	close sync.Once
+}
+
+var _ socks5.DataQuota = (*Manager)(nil)
+
+// NewManager loads the usage from the database and saves it until ctx is done
+func NewManager(ctx context.Context, log *logger.Logger, path string, conf Config, flush time.Duration) (*Manager, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: openTimeout})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %v: %v", path, err)
+	}
+	m := &Manager{
+		Log:   log,
+		conf:  conf,
+		db:    db,
+		users: make(map[string]*usage),
+		dirty: make(map[string]bool),
+		now:   time.Now,
+	}
+	if err := m.load(); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("failed to load %v: %v", path, err)
+	}
+	if flush <= 0 {
+		flush = DefaultFlushInterval
+	}
+	go m.run(ctx, flush)
+	return m, nil
+}
+
+func (m *Manager) load() error {
+	return m.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(usageBucket)
+		if err != nil {
+			return err
+		}
+		return b.ForEach(func(k, v []byte) error {
+			if len(v) != 16*int(windows) {
+				return fmt.Errorf("malformed usage of %q", k)
+			}
+			u := &usage{}
+			for w := Window(0); w < windows; w++ {
+				u.start[w] = int64(binary.BigEndian.Uint64(v[16*w:]))
+				u.used[w] = int64(binary.BigEndian.Uint64(v[16*w+8:]))
+			}
+			m.users[string(k)] = u
+			return nil
+		})
+	})
+}
+
+// Limits returns the data caps of the user
+func (m *Manager) Limits(user string) Limits {
+	if limits, found := m.conf.Users[user]; found {
+		return limits
+	}
+	if m.conf.UserGroups != nil && len(m.conf.Groups) > 0 {
+		var limits Limits
+		member := false
+		for _, group := range m.conf.UserGroups(user) {
+			g, found := m.conf.Groups[group]
+			if !found {
+				continue
+			}
+			if !member {
+				limits, member = g, true
+				continue
+			}
+			for w := range limits {
+				if limits[w] != 0 && (g[w] == 0 || g[w] > limits[w]) {
+					limits[w] = g[w]
+				}
+			}
+		}
+		if member {
+			return limits
+		}
+	}
+	return m.conf.Default
+}
+
+// Used returns the data used by the user in the current windows
+func (m *Manager) Used(user string) Limits {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u := m.current(user)
+	return Limits(u.used)
+}
+
+// current returns the usage of the user with the windows reset on schedule,
+// the lock must be held
+func (m *Manager) current(user string) *usage {
+	u, found := m.users[user]
+	if !found {
+		u = &usage{}
+		m.users[user] = u
+	}
+	now := m.now()
+	for w := Window(0); w < windows; w++ {
+		start := m.conf.Schedule.Start(w, now).Unix()
+		if u.start[w] != start {
+			u.start[w] = start
+			u.used[w] = 0
+			m.dirty[user] = true
+		}
+	}
+	return u
+}
+
+// CheckQuota returns an error if the user is over a data cap
+func (m *Manager) CheckQuota(user string) error {
+	limits := m.Limits(user)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u := m.current(user)
+	for w, limit := range limits {
+		if limit > 0 && u.used[w] >= limit {
+			return fmt.Errorf("%w: %v cap of %v bytes", socks5.DataQuotaExceeded, Window(w), limit)
+		}
+	}
+	return nil
+}
+
+// AddData counts the data of the user, returns false once the user is over a data cap
+func (m *Manager) AddData(user string, n int64) bool {
+	limits := m.Limits(user)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u := m.current(user)
+	allowed := true
+	for w, limit := range limits {
+		u.used[w] += n
+		if limit > 0 && u.used[w] >= limit {
+			allowed = false
+		}
+	}
+	m.dirty[user] = true
+	return allowed
+}
+
+func (m *Manager) run(ctx context.Context, flush time.Duration) {
+	ticker := time.NewTicker(flush)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := m.Flush(); err != nil {
+				m.Log.Lg.Warn().Msgf("failed to save data quota usage: %v", err)
+			}
+		}
+	}
+}
+
+// Flush saves the changed usage to the database
+func (m *Manager) Flush() error {
+	m.mu.Lock()
+	values := make(map[string][]byte, len(m.dirty))
+	for user := range m.dirty {
+		u := m.users[user]
+		v := make([]byte, 16*int(windows))
+		for w := Window(0); w < windows; w++ {
+			binary.BigEndian.PutUint64(v[16*w:], uint64(u.start[w]))
+			binary.BigEndian.PutUint64(v[16*w+8:], uint64(u.used[w]))
+		}
+		values[user] = v
+	}
+	m.dirty = make(map[string]bool)
+	m.mu.Unlock()
+	if len(values) == 0 {
+		return nil
+	}
+	err := m.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(usageBucket)
+		for user, v := range values {
+			if err := b.Put([]byte(user), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		// Save them with the next flush
+		m.mu.Lock()
+		for user := range values {
+			m.dirty[user] = true
+		}
+		m.mu.Unlock()
+	}
+	return err
+}
+
+// Close saves the usage and closes the database
+func (m *Manager) Close() error {
+	var err error
+	m.close.Do(func() {
+		err = m.Flush()
+		if cerr := m.db.Close(); err == nil {
+			err = cerr
+		}
+	})
+	return err
+}
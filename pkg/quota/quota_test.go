@@ -0,0 +1,110 @@
+package quota
+
+import (
+	"context"
+	"errors"
+	"github.com/dossif/gosocks5/pkg/logger"
+	"github.com/dossif/gosocks5/pkg/socks5"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSchedule_Start(t *testing.T) {
+	s := Schedule{Hour: 6, Weekday: time.Monday, Day: 15}
+	// Thursday
+	now := time.Date(2024, 5, 2, 5, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		window   Window
+		expected time.Time
+	}{
+		{Daily, time.Date(2024, 5, 1, 6, 0, 0, 0, time.UTC)},
+		{Weekly, time.Date(2024, 4, 29, 6, 0, 0, 0, time.UTC)},
+		{Monthly, time.Date(2024, 4, 15, 6, 0, 0, 0, time.UTC)},
+	} {
+		if start := s.Start(tc.window, now); !start.Equal(tc.expected) {
+			t.Errorf("%v: bad: %v", tc.window, start)
+		}
+	}
+	if start := s.Start(Daily, time.Date(2024, 5, 2, 6, 0, 0, 0, time.UTC)); !start.Equal(time.Date(2024, 5, 2, 6, 0, 0, 0, time.UTC)) {
+		t.Errorf("bad: %v", start)
+	}
+}
+
+func TestManager_Limits(t *testing.T) {
+	lg, _ := logger.NewLogger("debug")
+	m, err := NewManager(context.Background(), lg, filepath.Join(t.TempDir(), "quota.db"), Config{
+		Default: Limits{Daily: 100},
+		Users:   map[string]Limits{"alice": {Monthly: 1000}},
+		Groups: map[string]Limits{
+			"devops": {Daily: 200, Monthly: 5000},
+			"admins": {Daily: 0, Monthly: 3000},
+		},
+		UserGroups: func(user string) []string {
+			return map[string][]string{"alice": {"devops"}, "bob": {"devops", "admins"}, "carol": {"other"}}[user]
+		},
+	}, time.Hour)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m.Close()
+
+	for user, expected := range map[string]Limits{
+		"alice": {Monthly: 1000},
+		"bob":   {Daily: 0, Monthly: 5000},
+		"carol": {Daily: 100},
+	} {
+		if limits := m.Limits(user); limits != expected {
+			t.Errorf("%v: bad: %v", user, limits)
+		}
+	}
+}
+
+func TestManager_Enforce(t *testing.T) {
+	lg, _ := logger.NewLogger("debug")
+	path := filepath.Join(t.TempDir(), "quota.db")
+	conf := Config{Default: Limits{Daily: 100, Weekly: 250}}
+	now := time.Date(2024, 5, 2, 12, 0, 0, 0, time.UTC)
+
+	m, err := NewManager(context.Background(), lg, path, conf, time.Hour)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	m.now = func() time.Time { return now }
+	if !m.AddData("alice", 60) || m.CheckQuota("alice") != nil {
+		t.Fatalf("quota exceeded too early")
+	}
+	if m.AddData("alice", 40) {
+		t.Fatalf("daily cap is not enforced")
+	}
+	if err := m.CheckQuota("alice"); !errors.Is(err, socks5.DataQuotaExceeded) {
+		t.Fatalf("bad: %v", err)
+	}
+	if err := m.Close(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The usage survives a restart and the daily window resets on schedule
+	m, err = NewManager(context.Background(), lg, path, conf, time.Hour)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m.Close()
+	m.now = func() time.Time { return now }
+	if used := m.Used("alice"); used != (Limits{Daily: 100, Weekly: 100, Monthly: 100}) {
+		t.Fatalf("bad: %v", used)
+	}
+	m.now = func() time.Time { return now.Add(24 * time.Hour) }
+	if err := m.CheckQuota("alice"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if used := m.Used("alice"); used != (Limits{Daily: 0, Weekly: 100, Monthly: 100}) {
+		t.Fatalf("bad: %v", used)
+	}
+	m.AddData("alice", 99)
+	m.now = func() time.Time { return now.Add(48 * time.Hour) }
+	m.AddData("alice", 60)
+	if err := m.CheckQuota("alice"); err == nil || err.Error() != "data quota exceeded: weekly cap of 250 bytes" {
+		t.Fatalf("bad: %v", err)
+	}
+}
@@ -0,0 +1,130 @@
+package resolver
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dossif/gosocks5/pkg/logger"
+)
+
+const DefaultHostsInterval = time.Second * 10
+
+// Hosts is a static override table in hosts file format:
+// ip followed by names, "#" starts a comment.
+// The file is reloaded when it changes, a broken file keeps the previous table.
+type Hosts struct {
+	File string
+	Log  *logger.Logger
+
+	mu      sync.RWMutex
+	hosts   map[string][]net.IP
+	modTime time.Time
+	size    int64
+}
+
+// NewHosts loads the file and starts watching it until ctx is done
+func NewHosts(ctx context.Context, log *logger.Logger, file string, interval time.Duration) (*Hosts, error) {
+	h := &Hosts{File: file, Log: log}
+	if _, err := h.Reload(); err != nil {
+		return nil, err
+	}
+	if interval <= 0 {
+		interval = DefaultHostsInterval
+	}
+	go h.watch(ctx, interval)
+	return h, nil
+}
+
+// Lookup returns addresses of the name, which is matched exactly
+func (h *Hosts) Lookup(name string) ([]net.IP, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	ips, ok := h.hosts[normalize(name)]
+	return ips, ok
+}
+
+func (h *Hosts) watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			reloaded, err := h.Reload()
+			if err != nil {
+				h.Log.Lg.Warn().Msgf("failed to reload hosts, keep the previous ones: %v", err)
+			} else if reloaded {
+				h.Log.Lg.Info().Msgf("hosts %v reloaded", h.File)
+			}
+		}
+	}
+}
+
+// Reload loads the file if it changed since the last load
+func (h *Hosts) Reload() (bool, error) {
+	fi, err := os.Stat(h.File)
+	if err != nil {
+		return false, err
+	}
+	h.mu.RLock()
+	changed := h.hosts == nil || fi.ModTime() != h.modTime || fi.Size() != h.size
+	h.mu.RUnlock()
+	if !changed {
+		return false, nil
+	}
+
+	hosts, err := parseHosts(h.File)
+	if err != nil {
+		return false, err
+	}
+	h.mu.Lock()
+	h.hosts = hosts
+	h.modTime = fi.ModTime()
+	h.size = fi.Size()
+	h.mu.Unlock()
+	return true, nil
+}
+
+func parseHosts(file string) (map[string][]net.IP, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	hosts := make(map[string][]net.IP)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil || len(fields) < 2 {
+			return nil, fmt.Errorf("invalid hosts line %v:%v", file, n)
+		}
+		for _, name := range fields[1:] {
+			name = normalize(name)
+			hosts[name] = append(hosts[name], ip)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return hosts, nil
+}
+
+// normalize lower cases the name and removes the trailing dot
+func normalize(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
@@ -0,0 +1,69 @@
+package resolver
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dossif/gosocks5/pkg/logger"
+)
+
+func TestHosts_Reload(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "hosts")
+	content := "# pinned hosts\n10.0.0.1 db.corp.internal DB2.corp.internal.\n\n2001:db8::1 db.corp.internal # v6\n"
+	if err := os.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	lg, _ := logger.NewLogger("debug")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h, err := NewHosts(ctx, lg, file, 10*time.Millisecond)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	ips, ok := h.Lookup("DB.corp.internal.")
+	if !ok || len(ips) != 2 || !ips[0].Equal(net.ParseIP("10.0.0.1")) || !ips[1].Equal(net.ParseIP("2001:db8::1")) {
+		t.Fatalf("bad: %v", ips)
+	}
+	if _, ok := h.Lookup("db2.corp.internal"); !ok {
+		t.Fatalf("expected db2")
+	}
+	if _, ok := h.Lookup("corp.internal"); ok {
+		t.Fatalf("unexpected match")
+	}
+
+	// A broken file keeps the previous table
+	if err := os.WriteFile(file, []byte("not-an-ip db.corp.internal\n"), 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if _, ok := h.Lookup("db.corp.internal"); !ok {
+		t.Fatalf("expected previous hosts")
+	}
+
+	if err := os.WriteFile(file, []byte("10.0.0.2 cache.corp.internal\n"), 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if _, ok := h.Lookup("cache.corp.internal"); ok {
+			if _, ok := h.Lookup("db.corp.internal"); ok {
+				t.Fatalf("unexpected stale host")
+			}
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("hosts were not reloaded")
+}
+
+func TestNewHosts_MissingFile(t *testing.T) {
+	lg, _ := logger.NewLogger("debug")
+	if _, err := NewHosts(context.Background(), lg, "/nonexistent/hosts", 0); err == nil {
+		t.Fatalf("expected error")
+	}
+}
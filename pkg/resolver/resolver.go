@@ -0,0 +1,232 @@
+package resolver
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/dossif/gosocks5/pkg/logger"
+	"github.com/jellydator/ttlcache/v3"
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	DefaultTimeout     = time.Second * 5
+	DefaultMinTTL      = time.Second * 5
+	DefaultMaxTTL      = time.Hour
+	DefaultNegativeTTL = time.Second * 30
+	DefaultCacheSize   = 10000
+)
+
+// Config is used to set up a Resolver
+type Config struct {
+	// Servers are queried in order until one answers.
+	// Format: [udp://|tcp://]host[:port], port defaults to 53,
+	// tls://host[:port] for DNS over TLS, port defaults to 853,
+	// https://host[:port][/path] for DNS over HTTPS, path defaults to /dns-query.
+	Servers []string
+
+	// Bootstrap ips are dialed for tls and https servers given by host name,
+	// so the server name is not resolved with plaintext DNS.
+	Bootstrap []string
+
+	// TLSServerName overrides the name verified in tls and https server certificates.
+	// Defaults to the server host.
+	TLSServerName string
+
+	// RootCAs verify tls and https servers. System roots are used if nil.
+	RootCAs *x509.CertPool
+
+	// DoHMethod is GET or POST. Defaults to POST.
+	DoHMethod string
+
+	// Timeout limits a single query to a server. Defaults to 5 seconds.
+	Timeout time.Duration
+
+	// MinTTL and MaxTTL clamp record TTLs. Default to 5 seconds and 1 hour.
+	MinTTL time.Duration
+	MaxTTL time.Duration
+
+	// NegativeTTL limits caching of "no such host" answers. Defaults to 30 seconds.
+	NegativeTTL time.Duration
+
+	// CacheSize limits the number of cached names. Defaults to 10000.
+	CacheSize uint64
+}
+
+// Resolver is a caching socks5.NameResolver which queries DNS servers directly
+type Resolver struct {
+	lg      *logger.Logger
+	conf    Config
+	servers []server
+	cache   *ttlcache.Cache[string, *answer]
+	group   singleflight.Group
+}
+
+// answer is a cached lookup result, err is set for negative answers
+type answer struct {
+	ips []net.IP
+	err error
+}
+
+// NewResolver creates a Resolver, the cache is cleaned up until ctx is done
+func NewResolver(ctx context.Context, lg *logger.Logger, conf Config) (*Resolver, error) {
+	if len(conf.Servers) == 0 {
+		return nil, fmt.Errorf("no dns servers")
+	}
+	r := &Resolver{lg: lg, conf: conf}
+	for _, s := range conf.Servers {
+		srv, err := parseServer(s, conf)
+		if err != nil {
+			return nil, err
+		}
+		r.servers = append(r.servers, srv)
+	}
+	if r.conf.Timeout == 0 {
+		r.conf.Timeout = DefaultTimeout
+	}
+	if r.conf.MinTTL == 0 {
+		r.conf.MinTTL = DefaultMinTTL
+	}
+	if r.conf.MaxTTL == 0 {
+		r.conf.MaxTTL = DefaultMaxTTL
+	}
+	if r.conf.NegativeTTL == 0 {
+		r.conf.NegativeTTL = DefaultNegativeTTL
+	}
+	if r.conf.CacheSize == 0 {
+		r.conf.CacheSize = DefaultCacheSize
+	}
+	r.cache = ttlcache.New[string, *answer](
+		ttlcache.WithCapacity[string, *answer](r.conf.CacheSize), ttlcache.WithDisableTouchOnHit[string, *answer](),
+	)
+	go r.cache.Start()
+	go func() {
+		<-ctx.Done()
+		r.cache.Stop()
+	}()
+	return r, nil
+}
+
+// Resolve returns IPv4 and IPv6 addresses of the name from the cache or the DNS servers.
+// Concurrent lookups of the same name share a single query.
+func (r *Resolver) Resolve(ctx context.Context, name string) (context.Context, []net.IP, error) {
+	if ip := net.ParseIP(name); ip != nil {
+		return ctx, []net.IP{ip}, nil
+	}
+	fqdn := strings.ToLower(name)
+	if !strings.HasSuffix(fqdn, ".") {
+		fqdn += "."
+	}
+	if item := r.cache.Get(fqdn); item != nil {
+		a := item.Value()
+		return ctx, a.ips, a.err
+	}
+
+	ch := r.group.DoChan(fqdn, func() (interface{}, error) {
+		a, ttl, err := r.lookup(fqdn)
+		if err != nil {
+			return nil, err
+		}
+		r.cache.Set(fqdn, a, ttl)
+		return a, nil
+	})
+	select {
+	case res := <-ch:
+		if res.Err != nil {
+			return ctx, nil, res.Err
+		}
+		a := res.Val.(*answer)
+		return ctx, a.ips, a.err
+	case <-ctx.Done():
+		return ctx, nil, ctx.Err()
+	}
+}
+
+// lookup queries the servers in order for A and AAAA records of fqdn.
+// Returns the answer with its cache ttl or the error of the last server.
+func (r *Resolver) lookup(fqdn string) (*answer, time.Duration, error) {
+	qname, err := dnsmessage.NewName(fqdn)
+	if err != nil {
+		return nil, 0, &net.DNSError{Err: err.Error(), Name: fqdn}
+	}
+	var lastErr error
+	for _, srv := range r.servers {
+		a, ttl, err := r.lookupServer(srv, qname)
+		if err == nil {
+			return a, ttl, nil
+		}
+		r.lg.Lg.Debug().Msgf("dns server %v failed to resolve %v: %v", srv, fqdn, err)
+		lastErr = err
+	}
+	return nil, 0, lastErr
+}
+
+// lookupServer queries A and AAAA records in parallel
+func (r *Resolver) lookupServer(srv server, qname dnsmessage.Name) (*answer, time.Duration, error) {
+	type result struct {
+		resp dnsmessage.Message
+		err  error
+	}
+	types := []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA}
+	results := make(chan result, len(types))
+	for _, qtype := range types {
+		go func(qtype dnsmessage.Type) {
+			resp, err := srv.exchange(qname, qtype, r.conf.Timeout)
+			results <- result{resp, err}
+		}(qtype)
+	}
+
+	a := &answer{}
+	ttl := r.conf.MaxTTL
+	negTTL := r.conf.NegativeTTL
+	for range types {
+		res := <-results
+		if res.err != nil {
+			return nil, 0, res.err
+		}
+		switch res.resp.RCode {
+		case dnsmessage.RCodeSuccess, dnsmessage.RCodeNameError:
+		default:
+			return nil, 0, &net.DNSError{Err: fmt.Sprintf("server misbehaving: %v", res.resp.RCode), Name: qname.String(), Server: srv.String()}
+		}
+		for _, rr := range res.resp.Answers {
+			switch body := rr.Body.(type) {
+			case *dnsmessage.AResource:
+				a.ips = append(a.ips, net.IP(body.A[:]))
+			case *dnsmessage.AAAAResource:
+				a.ips = append(a.ips, net.IP(body.AAAA[:]))
+			default:
+				continue
+			}
+			if d := time.Duration(rr.Header.TTL) * time.Second; d < ttl {
+				ttl = d
+			}
+		}
+		// Negative answers are cached as in RFC 2308
+		for _, rr := range res.resp.Authorities {
+			if soa, ok := rr.Body.(*dnsmessage.SOAResource); ok {
+				d := time.Duration(rr.Header.TTL) * time.Second
+				if m := time.Duration(soa.MinTTL) * time.Second; m < d {
+					d = m
+				}
+				if d < negTTL {
+					negTTL = d
+				}
+			}
+		}
+	}
+
+	if len(a.ips) == 0 {
+		a.err = &net.DNSError{Err: "no such host", Name: qname.String(), Server: srv.String(), IsNotFound: true}
+		ttl = negTTL
+	}
+	if ttl < r.conf.MinTTL {
+		ttl = r.conf.MinTTL
+	}
+	return a, ttl, nil
+}
@@ -0,0 +1,226 @@
+package resolver
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dossif/gosocks5/pkg/logger"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// stubServer is an in-process DNS server on udp and tcp.
+// example.com has an A record, big.example.com is truncated over udp,
+// other names are NXDOMAIN.
+type stubServer struct {
+	addr    string
+	queries atomic.Int32
+	delay   time.Duration
+	ttl     uint32
+}
+
+func newStubServer(t *testing.T, ttl uint32, delay time.Duration) *stubServer {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	l, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	t.Cleanup(func() {
+		pc.Close()
+		l.Close()
+	})
+	s := &stubServer{addr: pc.LocalAddr().String(), ttl: ttl, delay: delay}
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			go func(query []byte) {
+				if resp := s.answer(t, query, true); resp != nil {
+					pc.WriteTo(resp, addr)
+				}
+			}(append([]byte(nil), buf[:n]...))
+		}
+	}()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serveStream(t, conn)
+		}
+	}()
+	return s
+}
+
+// serveStream answers a length prefixed query over tcp or tls
+func (s *stubServer) serveStream(t *testing.T, conn net.Conn) {
+	defer conn.Close()
+	var size [2]byte
+	if _, err := io.ReadFull(conn, size[:]); err != nil {
+		return
+	}
+	query := make([]byte, binary.BigEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(conn, query); err != nil {
+		return
+	}
+	resp := s.answer(t, query, false)
+	binary.BigEndian.PutUint16(size[:], uint16(len(resp)))
+	conn.Write(append(size[:], resp...))
+}
+
+func (s *stubServer) answer(t *testing.T, query []byte, udp bool) []byte {
+	s.queries.Add(1)
+	time.Sleep(s.delay)
+	var msg dnsmessage.Message
+	if err := msg.Unpack(query); err != nil {
+		t.Errorf("err: %v", err)
+		return nil
+	}
+	q := msg.Questions[0]
+	msg.Response = true
+	msg.Additionals = nil
+	switch q.Name.String() {
+	case "example.com.", "big.example.com.":
+		if q.Name.String() == "big.example.com." && udp {
+			msg.Truncated = true
+			break
+		}
+		if q.Type == dnsmessage.TypeA {
+			msg.Answers = append(msg.Answers, dnsmessage.Resource{
+				Header: dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: s.ttl},
+				Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}},
+			})
+		}
+	default:
+		msg.RCode = dnsmessage.RCodeNameError
+		soaName := dnsmessage.MustNewName("com.")
+		msg.Authorities = append(msg.Authorities, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: soaName, Type: dnsmessage.TypeSOA, Class: q.Class, TTL: 900},
+			Body:   &dnsmessage.SOAResource{NS: soaName, MBox: soaName, MinTTL: 15},
+		})
+	}
+	resp, err := msg.Pack()
+	if err != nil {
+		t.Errorf("err: %v", err)
+	}
+	return resp
+}
+
+func newTestResolver(t *testing.T, conf Config) *Resolver {
+	lg, _ := logger.NewLogger("debug")
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	r, err := NewResolver(ctx, lg, conf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return r
+}
+
+func TestResolver_Cache(t *testing.T) {
+	stub := newStubServer(t, 1, 0)
+	r := newTestResolver(t, Config{Servers: []string{stub.addr}, MinTTL: time.Minute})
+
+	for i := 0; i < 3; i++ {
+		_, ips, err := r.Resolve(context.Background(), "Example.com")
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if len(ips) != 1 || !ips[0].Equal(net.IPv4(192, 0, 2, 1)) {
+			t.Fatalf("bad: %v", ips)
+		}
+	}
+	if n := stub.queries.Load(); n != 2 {
+		t.Fatalf("bad queries: %v", n)
+	}
+
+	// The record ttl is clamped to MinTTL
+	if ttl := r.cache.Get("example.com.").TTL(); ttl != time.Minute {
+		t.Fatalf("bad ttl: %v", ttl)
+	}
+}
+
+func TestResolver_Negative(t *testing.T) {
+	stub := newStubServer(t, 60, 0)
+	r := newTestResolver(t, Config{Servers: []string{stub.addr}})
+
+	for i := 0; i < 2; i++ {
+		_, _, err := r.Resolve(context.Background(), "missing.example.com")
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			t.Fatalf("bad: %v", err)
+		}
+	}
+	if n := stub.queries.Load(); n != 2 {
+		t.Fatalf("bad queries: %v", n)
+	}
+
+	// The negative ttl is taken from the soa
+	if ttl := r.cache.Get("missing.example.com.").TTL(); ttl != 15*time.Second {
+		t.Fatalf("bad ttl: %v", ttl)
+	}
+}
+
+func TestResolver_Coalesce(t *testing.T) {
+	stub := newStubServer(t, 60, 50*time.Millisecond)
+	r := newTestResolver(t, Config{Servers: []string{stub.addr}})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, _, err := r.Resolve(context.Background(), "example.com"); err != nil {
+				t.Errorf("err: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := stub.queries.Load(); n != 2 {
+		t.Fatalf("bad queries: %v", n)
+	}
+}
+
+func TestResolver_Fallback(t *testing.T) {
+	stub := newStubServer(t, 60, 0)
+
+	// Nothing listens on the first server
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	dead := pc.LocalAddr().String()
+	pc.Close()
+
+	r := newTestResolver(t, Config{Servers: []string{dead, "udp://" + stub.addr}, Timeout: 100 * time.Millisecond})
+	if _, ips, err := r.Resolve(context.Background(), "example.com"); err != nil || len(ips) != 1 {
+		t.Fatalf("bad: %v %v", ips, err)
+	}
+}
+
+func TestResolver_Truncated(t *testing.T) {
+	stub := newStubServer(t, 60, 0)
+	r := newTestResolver(t, Config{Servers: []string{stub.addr}})
+
+	if _, ips, err := r.Resolve(context.Background(), "big.example.com"); err != nil || len(ips) != 1 {
+		t.Fatalf("bad: %v %v", ips, err)
+	}
+	// Both queries are retried over tcp
+	if n := stub.queries.Load(); n != 4 {
+		t.Fatalf("bad queries: %v", n)
+	}
+}
@@ -0,0 +1,69 @@
+package resolver
+
+import (
+	"context"
+	"net"
+	"strings"
+
+	"github.com/dossif/gosocks5/pkg/socks5"
+)
+
+var (
+	_ socks5.NameResolver = (*Resolver)(nil)
+	_ socks5.NameResolver = (*Router)(nil)
+)
+
+// Router is a split-horizon socks5.NameResolver. Names are looked up
+// in the hosts overrides first, then sent to the resolver of the longest
+// matching domain suffix, then to the default resolver.
+type Router struct {
+	// Hosts are optional static overrides
+	Hosts *Hosts
+
+	// Routes map domain suffixes to resolvers. A suffix matches
+	// the domain itself and all of its subdomains.
+	Routes map[string]socks5.NameResolver
+
+	// Default resolves names without a matching route.
+	// If nil such names are not found.
+	Default socks5.NameResolver
+}
+
+// NewRouter creates a Router, route suffixes are normalized
+func NewRouter(hosts *Hosts, routes map[string]socks5.NameResolver, def socks5.NameResolver) *Router {
+	r := &Router{Hosts: hosts, Routes: make(map[string]socks5.NameResolver, len(routes)), Default: def}
+	for suffix, res := range routes {
+		r.Routes[normalize(suffix)] = res
+	}
+	return r
+}
+
+func (r *Router) Resolve(ctx context.Context, name string) (context.Context, []net.IP, error) {
+	if ip := net.ParseIP(name); ip != nil {
+		return ctx, []net.IP{ip}, nil
+	}
+	if r.Hosts != nil {
+		if ips, ok := r.Hosts.Lookup(name); ok {
+			return ctx, ips, nil
+		}
+	}
+	if res := r.route(normalize(name)); res != nil {
+		return res.Resolve(ctx, name)
+	}
+	return ctx, nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+// route returns the resolver of the longest matching suffix or the default one
+func (r *Router) route(name string) socks5.NameResolver {
+	for suffix := name; suffix != ""; {
+		if res, ok := r.Routes[suffix]; ok {
+			return res
+		}
+		_, parent, found := strings.Cut(suffix, ".")
+		if !found {
+			break
+		}
+		suffix = parent
+	}
+	return r.Default
+}
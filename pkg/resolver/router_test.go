@@ -0,0 +1,66 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dossif/gosocks5/pkg/logger"
+	"github.com/dossif/gosocks5/pkg/socks5"
+)
+
+type staticResolver net.IP
+
+func (r staticResolver) Resolve(ctx context.Context, _ string) (context.Context, []net.IP, error) {
+	return ctx, []net.IP{net.IP(r)}, nil
+}
+
+func TestRouter(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "hosts")
+	if err := os.WriteFile(file, []byte("10.9.9.9 pinned.corp.internal\n"), 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	lg, _ := logger.NewLogger("debug")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	hosts, err := NewHosts(ctx, lg, file, 0)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	corp := staticResolver(net.IPv4(10, 0, 0, 1))
+	lab := staticResolver(net.IPv4(10, 1, 0, 1))
+	public := staticResolver(net.IPv4(192, 0, 2, 1))
+	routes := map[string]socks5.NameResolver{"Corp.Internal.": corp, "lab.corp.internal": lab}
+
+	for _, tc := range []struct {
+		name     string
+		def      socks5.NameResolver
+		expected net.IP
+	}{
+		{"corp.internal", public, net.IP(corp)},
+		{"git.corp.internal", public, net.IP(corp)},
+		{"host.lab.corp.internal", public, net.IP(lab)},
+		{"pinned.corp.internal", public, net.IPv4(10, 9, 9, 9)},
+		{"notcorp.internal", public, net.IP(public)},
+		{"example.com", public, net.IP(public)},
+		{"192.0.2.7", nil, net.IPv4(192, 0, 2, 7)},
+		{"example.com", nil, nil},
+	} {
+		r := NewRouter(hosts, routes, tc.def)
+		_, ips, err := r.Resolve(context.Background(), tc.name)
+		if tc.expected == nil {
+			var dnsErr *net.DNSError
+			if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+				t.Errorf("%v: expected not found: %v", tc.name, err)
+			}
+			continue
+		}
+		if err != nil || len(ips) != 1 || !ips[0].Equal(tc.expected) {
+			t.Errorf("%v: bad: %v %v", tc.name, ips, err)
+		}
+	}
+}
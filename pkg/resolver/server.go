@@ -0,0 +1,335 @@
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// maxUDPSize is the advertised EDNS0 udp payload size
+	maxUDPSize = 1232
+	// dohMediaType is the DNS wire format media type as in RFC 8484
+	dohMediaType = "application/dns-message"
+)
+
+// transport sends a packed query to a DNS server and returns the packed response
+type transport interface {
+	roundTrip(query []byte, timeout time.Duration) ([]byte, error)
+	String() string
+}
+
+// server is a DNS server queried over udp, tcp, tls or https
+type server struct {
+	transport
+	// tcp retries truncated udp responses
+	tcp transport
+	// zeroID is set for https as recommended by RFC 8484
+	zeroID bool
+}
+
+// parseServer parses [udp://|tcp://|tls://]host[:port] and https://host[:port][/path]
+func parseServer(s string, conf Config) (server, error) {
+	scheme, addr, ok := strings.Cut(s, "://")
+	if !ok {
+		scheme, addr = "udp", s
+	}
+	switch scheme {
+	case "udp", "tcp":
+		addr, err := withPort(addr, "53")
+		if err != nil {
+			return server{}, fmt.Errorf("invalid dns server address %v: %v", s, err)
+		}
+		srv := server{transport: plainTransport{network: scheme, addr: addr}}
+		if scheme == "udp" {
+			srv.tcp = plainTransport{network: "tcp", addr: addr}
+		}
+		return srv, nil
+	case "tls":
+		addr, err := withPort(addr, "853")
+		if err != nil {
+			return server{}, fmt.Errorf("invalid dns server address %v: %v", s, err)
+		}
+		host, _, _ := net.SplitHostPort(addr)
+		return server{transport: tlsTransport{
+			addr: addr,
+			dial: bootstrapDial(conf.Bootstrap),
+			conf: tlsConfig(host, conf),
+		}}, nil
+	case "https":
+		u, err := url.Parse(s)
+		if err != nil || u.Host == "" {
+			return server{}, fmt.Errorf("invalid dns server url %v: %v", s, err)
+		}
+		if u.Path == "" {
+			u.Path = "/dns-query"
+		}
+		method := strings.ToUpper(conf.DoHMethod)
+		if method == "" {
+			method = http.MethodPost
+		}
+		if method != http.MethodGet && method != http.MethodPost {
+			return server{}, fmt.Errorf("unsupported doh method %v", conf.DoHMethod)
+		}
+		return server{zeroID: true, transport: httpsTransport{
+			url:    u,
+			method: method,
+			client: &http.Client{Transport: &http.Transport{
+				DialContext:       bootstrapDial(conf.Bootstrap),
+				TLSClientConfig:   tlsConfig(u.Hostname(), conf),
+				ForceAttemptHTTP2: true,
+				IdleConnTimeout:   time.Minute,
+			}},
+		}}, nil
+	}
+	return server{}, fmt.Errorf("unsupported dns server scheme %v", scheme)
+}
+
+// withPort adds the default port to the address without one
+func withPort(addr, port string) (string, error) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(strings.Trim(addr, "[]"), port)
+	}
+	_, _, err := net.SplitHostPort(addr)
+	return addr, err
+}
+
+// tlsConfig verifies the server name, which defaults to the host of the server
+func tlsConfig(host string, conf Config) *tls.Config {
+	serverName := conf.TLSServerName
+	if serverName == "" {
+		serverName = host
+	}
+	return &tls.Config{
+		ServerName: serverName,
+		RootCAs:    conf.RootCAs,
+		MinVersion: tls.VersionTLS12,
+	}
+}
+
+// bootstrapDial dials the bootstrap addresses in order instead of resolving
+// the server host name. Servers given by ip are dialed as is.
+func bootstrapDial(bootstrap []string) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	var d net.Dialer
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil || len(bootstrap) == 0 || net.ParseIP(host) != nil {
+			return d.DialContext(ctx, network, addr)
+		}
+		var lastErr error
+		for _, ip := range bootstrap {
+			conn, err := d.DialContext(ctx, network, net.JoinHostPort(ip, port))
+			if err == nil {
+				return conn, nil
+			}
+			lastErr = err
+		}
+		return nil, lastErr
+	}
+}
+
+// exchange sends the question and returns the response.
+// Truncated udp responses are retried over tcp.
+func (s server) exchange(name dnsmessage.Name, qtype dnsmessage.Type, timeout time.Duration) (dnsmessage.Message, error) {
+	var id uint16
+	if !s.zeroID {
+		id = uint16(rand.Uint32())
+	}
+	query, err := newQuery(id, name, qtype)
+	if err != nil {
+		return dnsmessage.Message{}, err
+	}
+	t := s.transport
+	for {
+		raw, err := t.roundTrip(query, timeout)
+		if err != nil {
+			return dnsmessage.Message{}, &net.DNSError{Err: err.Error(), Name: name.String(), Server: s.String(), IsTimeout: isTimeout(err)}
+		}
+		var resp dnsmessage.Message
+		if err := resp.Unpack(raw); err != nil {
+			return dnsmessage.Message{}, &net.DNSError{Err: fmt.Sprintf("cannot unmarshal response: %v", err), Name: name.String(), Server: s.String()}
+		}
+		if !resp.Response || resp.ID != id || len(resp.Questions) != 1 ||
+			resp.Questions[0].Type != qtype || !strings.EqualFold(resp.Questions[0].Name.String(), name.String()) {
+			return dnsmessage.Message{}, &net.DNSError{Err: "response does not match the query", Name: name.String(), Server: s.String()}
+		}
+		if resp.Truncated && s.tcp != nil && t != s.tcp {
+			t = s.tcp
+			continue
+		}
+		return resp, nil
+	}
+}
+
+// newQuery packs a recursive query with EDNS0
+func newQuery(id uint16, name dnsmessage.Name, qtype dnsmessage.Type) ([]byte, error) {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, RecursionDesired: true})
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(dnsmessage.Question{Name: name, Type: qtype, Class: dnsmessage.ClassINET}); err != nil {
+		return nil, err
+	}
+	if err := b.StartAdditionals(); err != nil {
+		return nil, err
+	}
+	var opt dnsmessage.ResourceHeader
+	if err := opt.SetEDNS0(maxUDPSize, dnsmessage.RCodeSuccess, false); err != nil {
+		return nil, err
+	}
+	if err := b.OPTResource(opt, dnsmessage.OPTResource{}); err != nil {
+		return nil, err
+	}
+	return b.Finish()
+}
+
+// plainTransport queries over udp or tcp
+type plainTransport struct {
+	network string
+	addr    string
+}
+
+func (t plainTransport) String() string {
+	return t.network + "://" + t.addr
+}
+
+func (t plainTransport) roundTrip(query []byte, timeout time.Duration) ([]byte, error) {
+	conn, err := net.DialTimeout(t.network, t.addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+
+	if t.network == "udp" {
+		if _, err := conn.Write(query); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, maxUDPSize)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+	return streamRoundTrip(conn, query)
+}
+
+// tlsTransport queries over tls as in RFC 7858
+type tlsTransport struct {
+	addr string
+	dial func(ctx context.Context, network, addr string) (net.Conn, error)
+	conf *tls.Config
+}
+
+func (t tlsTransport) String() string {
+	return "tls://" + t.addr
+}
+
+func (t tlsTransport) roundTrip(query []byte, timeout time.Duration) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	raw, err := t.dial(ctx, "tcp", t.addr)
+	if err != nil {
+		return nil, err
+	}
+	conn := tls.Client(raw, t.conf)
+	defer func() {
+		_ = conn.Close()
+	}()
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+	if err := conn.HandshakeContext(ctx); err != nil {
+		return nil, err
+	}
+	return streamRoundTrip(conn, query)
+}
+
+// streamRoundTrip writes and reads messages prefixed with the two byte length
+func streamRoundTrip(conn net.Conn, query []byte) ([]byte, error) {
+	msg := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(msg, uint16(len(query)))
+	copy(msg[2:], query)
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+	var size [2]byte
+	if _, err := io.ReadFull(conn, size[:]); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, binary.BigEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// httpsTransport queries over https as in RFC 8484
+type httpsTransport struct {
+	url    *url.URL
+	method string
+	client *http.Client
+}
+
+func (t httpsTransport) String() string {
+	return t.url.String()
+}
+
+func (t httpsTransport) roundTrip(query []byte, timeout time.Duration) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var req *http.Request
+	var err error
+	if t.method == http.MethodGet {
+		u := *t.url
+		q := u.Query()
+		q.Set("dns", base64.RawURLEncoding.EncodeToString(query))
+		u.RawQuery = q.Encode()
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	} else {
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, t.url.String(), bytes.NewReader(query))
+		if req != nil {
+			req.Header.Set("Content-Type", dohMediaType)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", dohMediaType)
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected http status %v", resp.Status)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != dohMediaType {
+		return nil, fmt.Errorf("unexpected content type %v", ct)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 0xffff))
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,130 @@
+package resolver
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// newDoHServer serves the stub over https, the test certificate
+// is valid for example.com and 127.0.0.1
+func newDoHServer(t *testing.T, stub *stubServer) *httptest.Server {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var query []byte
+		var err error
+		switch r.Method {
+		case http.MethodGet:
+			query, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		case http.MethodPost:
+			if r.Header.Get("Content-Type") != dohMediaType {
+				http.Error(w, "bad content type", http.StatusUnsupportedMediaType)
+				return
+			}
+			query, err = io.ReadAll(r.Body)
+		}
+		if err != nil || len(query) == 0 {
+			http.Error(w, "bad query", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", dohMediaType)
+		w.Write(stub.answer(t, query, false))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// newDoTServer serves the stub over tls with the certificate of the https server
+func newDoTServer(t *testing.T, stub *stubServer, doh *httptest.Server) string {
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: doh.TLS.Certificates})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	t.Cleanup(func() {
+		l.Close()
+	})
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go stub.serveStream(t, conn)
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestResolver_Encrypted(t *testing.T) {
+	stub := newStubServer(t, 60, 0)
+	doh := newDoHServer(t, stub)
+	dot := newDoTServer(t, stub, doh)
+	dohURL, _ := url.Parse(doh.URL)
+	_, dotPort, _ := net.SplitHostPort(dot)
+
+	for _, tc := range []struct {
+		name string
+		conf Config
+	}{
+		{"dot", Config{Servers: []string{"tls://" + dot}}},
+		{"dot bootstrap", Config{Servers: []string{"tls://dns.test:" + dotPort}, Bootstrap: []string{"127.0.0.1"}, TLSServerName: "example.com"}},
+		{"doh post", Config{Servers: []string{doh.URL}}},
+		{"doh get", Config{Servers: []string{doh.URL}, DoHMethod: "get"}},
+		{"doh bootstrap", Config{Servers: []string{"https://dns.test:" + dohURL.Port() + "/dns-query"}, Bootstrap: []string{"127.0.0.1"}, TLSServerName: "example.com"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.conf.RootCAs = doh.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+			r := newTestResolver(t, tc.conf)
+			_, ips, err := r.Resolve(context.Background(), "example.com")
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			if len(ips) != 1 || !ips[0].Equal(net.IPv4(192, 0, 2, 1)) {
+				t.Fatalf("bad: %v", ips)
+			}
+		})
+	}
+}
+
+func TestResolver_UntrustedServer(t *testing.T) {
+	stub := newStubServer(t, 60, 0)
+	doh := newDoHServer(t, stub)
+	dot := newDoTServer(t, stub, doh)
+
+	// The test certificate is not in the system roots
+	r := newTestResolver(t, Config{Servers: []string{"tls://" + dot, doh.URL}, Timeout: time.Second})
+	if _, _, err := r.Resolve(context.Background(), "example.com"); err == nil {
+		t.Fatalf("expected error")
+	}
+	if n := stub.queries.Load(); n != 0 {
+		t.Fatalf("bad queries: %v", n)
+	}
+}
+
+func TestParseServer(t *testing.T) {
+	for in, expected := range map[string]string{
+		"8.8.8.8":                "udp://8.8.8.8:53",
+		"tcp://1.1.1.1":          "tcp://1.1.1.1:53",
+		"udp://10.0.0.1:5353":    "udp://10.0.0.1:5353",
+		"[2001:4860:4860::8888]": "udp://[2001:4860:4860::8888]:53",
+		"tls://dns.google":       "tls://dns.google:853",
+		"https://dns.google":     "https://dns.google/dns-query",
+	} {
+		srv, err := parseServer(in, Config{})
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if srv.String() != expected {
+			t.Errorf("%v: bad: %v", in, srv)
+		}
+	}
+	if _, err := parseServer("quic://8.8.8.8", Config{}); err == nil {
+		t.Fatalf("expected error")
+	}
+}
@@ -0,0 +1,357 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// udpBufSize fits the largest possible udp datagram
+	udpBufSize = 64 * 1024
+	// udpPendingPackets limits the datagrams queued while a destination is being opened
+	udpPendingPackets = 8
+	// udpDeniedTTL is how long datagrams to denied or failed destinations are dropped
+	// without checking them again
+	udpDeniedTTL = time.Second * 10
+)
+
+// udpAssociation keeps the state of a single udp associate request.
+// Each destination gets its own outbound socket in the nat table.
+type udpAssociation struct {
+	ctx    context.Context
+	s      *Server
+	req    *Request
+	ctrl   conn
+	relay  *net.UDPConn
+	limits *packetLimiter
+
+	mu     sync.Mutex
+	client *net.UDPAddr
+	nat    map[string]*udpNatEntry
+	// pending holds the queued datagrams of destinations being opened
+	pending map[string][][]byte
+	// denied caches destinations refused by the rules or failed to open until the time
+	denied map[string]time.Time
+	closed bool
+}
+
+// udpNatEntry maps a destination requested by the client to an outbound socket
+type udpNatEntry struct {
+	dest     *AddrSpec
+	target   *net.UDPConn
+	lastSeen atomic.Int64
+	traffic  *trafficCounter
+}
+
+func (e *udpNatEntry) touch() {
+	e.lastSeen.Store(time.Now().UnixNano())
+}
+
+func (e *udpNatEntry) idle(timeout time.Duration) bool {
+	return time.Since(time.Unix(0, e.lastSeen.Load())) >= timeout
+}
+
+func newUDPAssociation(ctx context.Context, s *Server, req *Request, ctrl conn, relay *net.UDPConn) *udpAssociation {
+	return &udpAssociation{
+		ctx:     ctx,
+		s:       s,
+		req:     req,
+		ctrl:    ctrl,
+		relay:   relay,
+		limits:  s.limitPackets(req),
+		nat:     make(map[string]*udpNatEntry),
+		pending: make(map[string][][]byte),
+		denied:  make(map[string]time.Time),
+	}
+}
+
+// serve reads datagrams from the client until the relay socket is closed
+func (a *udpAssociation) serve() {
+	buf := make([]byte, udpBufSize)
+	for {
+		n, src, err := a.relay.ReadFromUDP(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				a.req.Lg.Lg.Warn().Msgf("failed to read udp relay: %v", err)
+			}
+			return
+		}
+		if !a.allowSource(src) {
+			a.req.Lg.Lg.Debug().Msgf("drop udp datagram from unexpected client %v", src)
+			continue
+		}
+		if err := a.handleDatagram(buf[:n]); err != nil {
+			a.req.Lg.Lg.Debug().Msgf("drop udp datagram: %v", err)
+		}
+	}
+}
+
+// allowSource checks that a datagram comes from the client which owns the association.
+// The first accepted datagram pins the client address.
+func (a *udpAssociation) allowSource(src *net.UDPAddr) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.client != nil {
+		return a.client.IP.Equal(src.IP) && a.client.Port == src.Port
+	}
+	if a.req.RemoteAddr != nil && !a.req.RemoteAddr.IP.Equal(src.IP) {
+		return false
+	}
+	if a.req.DestAddr.Port != 0 && a.req.DestAddr.Port != src.Port {
+		return false
+	}
+	a.client = src
+	return true
+}
+
+func (a *udpAssociation) clientAddr() *net.UDPAddr {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.client
+}
+
+// handleDatagram parses the udp request header and sends the payload to the destination
+func (a *udpAssociation) handleDatagram(pkt []byte) error {
+	// RSV(2) FRAG(1) ATYP DST.ADDR DST.PORT DATA
+	if len(pkt) < 4 {
+		return fmt.Errorf("short udp header")
+	}
+	if pkt[2] != 0 {
+		return fmt.Errorf("udp fragmentation is not supported")
+	}
+	r := bytes.NewReader(pkt[3:])
+	dest, err := ReadAddrSpec(r)
+	if err != nil {
+		return fmt.Errorf("failed to read destination address: %v", err)
+	}
+	data := pkt[len(pkt)-r.Len():]
+
+	entry, err := a.natEntry(dest, data)
+	if entry == nil || err != nil {
+		return err
+	}
+	return a.send(entry, data)
+}
+
+// send writes the datagram to the destination of the nat entry
+func (a *udpAssociation) send(entry *udpNatEntry, data []byte) error {
+	entry.touch()
+	if !a.limits.allowUp(len(data)) {
+		return fmt.Errorf("datagram to %v is over the rate limit", entry.dest)
+	}
+	n, err := entry.target.Write(data)
+	entry.traffic.addUp(int64(n))
+	if err != nil {
+		return fmt.Errorf("failed to send datagram to %v: %v", entry.dest, err)
+	}
+	return nil
+}
+
+// natEntry returns the outbound socket for the destination. A new destination
+// is opened in the background, so rules and name resolution do not block the relay,
+// meanwhile the datagrams are queued and nil is returned.
+func (a *udpAssociation) natEntry(dest *AddrSpec, data []byte) (*udpNatEntry, error) {
+	key := dest.Address()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if entry, found := a.nat[key]; found {
+		return entry, nil
+	}
+	if until, found := a.denied[key]; found {
+		if time.Now().Before(until) {
+			return nil, fmt.Errorf("destination %v is denied", dest)
+		}
+		delete(a.denied, key)
+	}
+	if queue, found := a.pending[key]; found {
+		if len(queue) >= udpPendingPackets {
+			return nil, fmt.Errorf("destination %v is not ready", dest)
+		}
+		a.pending[key] = append(queue, append([]byte(nil), data...))
+		return nil, nil
+	}
+	if limit := a.s.config.UDPMaxDestinations; len(a.nat)+len(a.pending) >= limit {
+		return nil, fmt.Errorf("too many udp destinations: %v", limit)
+	}
+	a.pending[key] = [][]byte{append([]byte(nil), data...)}
+	go a.open(key, dest)
+	return nil, nil
+}
+
+// open checks and dials a new destination and sends the queued datagrams.
+// Denied destinations are cached for udpDeniedTTL.
+func (a *udpAssociation) open(key string, dest *AddrSpec) {
+	target, realDest, err := a.dial(dest)
+	a.mu.Lock()
+	queue := a.pending[key]
+	delete(a.pending, key)
+	if err != nil || a.closed {
+		if err != nil && !a.closed {
+			a.deny(key)
+		}
+		a.mu.Unlock()
+		if target != nil {
+			_ = target.Close()
+		}
+		if err != nil {
+			a.req.Lg.Lg.Debug().Msgf("drop udp datagrams to %v: %v", dest, err)
+		}
+		return
+	}
+	entry := &udpNatEntry{dest: dest, target: target, traffic: a.s.newTrafficCounter(a.req, a.stop)}
+	entry.touch()
+	a.nat[key] = entry
+	a.mu.Unlock()
+
+	a.req.Lg.Lg.Trace().Msgf("add udp nat entry %v -> %v", dest, realDest)
+	go a.forward(key, entry)
+	for _, data := range queue {
+		if err := a.send(entry, data); err != nil {
+			a.req.Lg.Lg.Debug().Msgf("drop udp datagram: %v", err)
+		}
+	}
+}
+
+// dial runs the request pipeline for the destination, every destination
+// is checked as a separate request, and dials the actual destination
+func (a *udpAssociation) dial(dest *AddrSpec) (*net.UDPConn, *AddrSpec, error) {
+	req := &Request{
+		Id:          a.req.Id,
+		Lg:          a.req.Lg,
+		Version:     socks5Version,
+		Command:     AssociateCommand,
+		AuthContext: a.req.AuthContext,
+		RemoteAddr:  a.req.RemoteAddr,
+		DestAddr:    dest,
+		Datagram:    true,
+	}
+	ctx, err := a.s.prepareRequest(a.ctx, req)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(req.realDestAddr.IP) == 0 {
+		if ctx, err = a.s.resolveRealDest(ctx, req); err != nil {
+			return nil, nil, err
+		}
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", (&net.UDPAddr{IP: req.realDestAddr.IP, Port: req.realDestAddr.Port}).String())
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to dial %v: %v", req.realDestAddr, err)
+	}
+	return conn.(*net.UDPConn), req.realDestAddr, nil
+}
+
+// resolveRealDest resolves a destination rewritten to a name, udp sockets are dialed
+// by ip. The resolved address is checked by the rules of the final phase again.
+func (s *Server) resolveRealDest(ctx context.Context, req *Request) (context.Context, error) {
+	dest := req.realDestAddr
+	if dest.FQDN == "" {
+		return ctx, fmt.Errorf("destination %v has no address", dest)
+	}
+	start := time.Now()
+	ctx, addrs, err := s.config.Resolver.Resolve(ctx, dest.FQDN)
+	s.metrics().Resolved(time.Since(start), err)
+	if err != nil {
+		return ctx, &ResolveError{Name: dest.FQDN, Err: err}
+	}
+	addrs = sortAddrs(addrs, s.config.FamilyPreference)
+	if len(addrs) == 0 {
+		return ctx, &ResolveError{Name: dest.FQDN, Err: fmt.Errorf("no %v addresses", s.config.FamilyPreference)}
+	}
+	req.realDestAddr = &AddrSpec{FQDN: dest.FQDN, IP: addrs[0], Port: dest.Port}
+	return s.checkRules(ctx, req, Final)
+}
+
+// deny caches the destination as denied, expired entries are dropped
+// once the cache is full. The lock must be held.
+func (a *udpAssociation) deny(key string) {
+	now := time.Now()
+	if len(a.denied) >= a.s.config.UDPMaxDestinations {
+		for k, until := range a.denied {
+			if !now.Before(until) {
+				delete(a.denied, k)
+			}
+		}
+		if len(a.denied) >= a.s.config.UDPMaxDestinations {
+			return
+		}
+	}
+	a.denied[key] = now.Add(udpDeniedTTL)
+}
+
+// forward sends datagrams from the destination back to the client
+// and removes the nat entry once it is idle
+func (a *udpAssociation) forward(key string, entry *udpNatEntry) {
+	defer a.remove(key, entry)
+	timeout := a.s.config.UDPIdleTimeout
+	buf := make([]byte, udpBufSize)
+	for {
+		_ = entry.target.SetReadDeadline(time.Now().Add(timeout))
+		n, err := entry.target.Read(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() && !entry.idle(timeout) {
+				continue
+			}
+			return
+		}
+		entry.touch()
+		client := a.clientAddr()
+		if client == nil {
+			continue
+		}
+		if !a.limits.allowDown(n) {
+			a.req.Lg.Lg.Debug().Msgf("drop udp datagram from %v: over the rate limit", entry.dest)
+			continue
+		}
+		pkt, err := AppendAddrSpec([]byte{0, 0, 0}, entry.dest)
+		if err != nil {
+			a.req.Lg.Lg.Warn().Msgf("failed to build udp header: %v", err)
+			continue
+		}
+		if _, err := a.relay.WriteToUDP(append(pkt, buf[:n]...), client); err != nil {
+			a.req.Lg.Lg.Debug().Msgf("failed to send datagram to client %v: %v", client, err)
+			continue
+		}
+		entry.traffic.addDown(int64(n))
+	}
+}
+
+func (a *udpAssociation) remove(key string, entry *udpNatEntry) {
+	a.mu.Lock()
+	if a.nat[key] == entry {
+		delete(a.nat, key)
+	}
+	a.mu.Unlock()
+	_ = entry.target.Close()
+	a.req.Lg.Lg.Trace().Msgf("remove udp nat entry %v", entry.dest)
+	a.s.recordTraffic(a.req, entry.dest, entry.traffic)
+}
+
+// close tears down the relay socket and all nat entries
+// stop closes the relay and ends the control connection, e.g. over the data quota
+func (a *udpAssociation) stop() {
+	a.close()
+	if c, ok := a.ctrl.(net.Conn); ok {
+		stopConn(c)()
+	}
+}
+
+func (a *udpAssociation) close() {
+	_ = a.relay.Close()
+	a.mu.Lock()
+	a.closed = true
+	for _, entry := range a.nat {
+		_ = entry.target.Close()
+	}
+	a.mu.Unlock()
+	a.limits.close()
+	a.req.Lg.Lg.Trace().Msgf("close udp relay")
+}
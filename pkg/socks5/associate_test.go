@@ -0,0 +1,231 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type denyPort int
+
+func (d denyPort) Allow(ctx context.Context, req *Request) (context.Context, bool) {
+	return ctx, req.DestAddr.Port != int(d)
+}
+
+func TestSOCKS5_Associate(t *testing.T) {
+	// Create a local udp echo server
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, src, err := echo.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			_, _ = echo.WriteToUDP(buf[:n], src)
+		}
+	}()
+	echoAddr := echo.LocalAddr().(*net.UDPAddr)
+
+	// Create a socks server
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	serv, err := New(ctx, testLogger(t), &Config{Rules: denyPort(9)})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	go func() {
+		_ = serv.ServeListener(l)
+	}()
+
+	// Get a local conn
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+
+	// Connect, auth and associate
+	conn.Write([]byte{5, 1, NoAuth})
+	conn.Write([]byte{5, 3, 0, 1, 0, 0, 0, 0, 0, 0})
+	out := make([]byte, 12)
+	if _, err := io.ReadAtLeast(conn, out, len(out)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(out[:6], []byte{socks5Version, NoAuth, 5, SuccessReply, 0, ipv4Address}) {
+		t.Fatalf("bad: %v", out)
+	}
+	relayAddr := &net.UDPAddr{IP: net.IP(out[6:10]), Port: int(binary.BigEndian.Uint16(out[10:]))}
+
+	client, err := net.DialUDP("udp", nil, relayAddr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(time.Second))
+
+	// A blocked destination is dropped silently
+	client.Write([]byte{0, 0, 0, ipv4Address, 127, 0, 0, 1, 0, 9, 'n', 'o'})
+
+	// Send a ping to the echo server
+	pkt := []byte{0, 0, 0, ipv4Address, 127, 0, 0, 1, 0, 0}
+	binary.BigEndian.PutUint16(pkt[8:], uint16(echoAddr.Port))
+	client.Write(append(pkt, []byte("ping")...))
+
+	// Verify the echo comes back with the destination header
+	buf := make([]byte, 1024)
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(buf[:n], append(pkt, []byte("ping")...)) {
+		t.Fatalf("bad: %v", buf[:n])
+	}
+
+	// Closing the control connection tears down the relay
+	conn.Close()
+	time.Sleep(50 * time.Millisecond)
+	client.Write(append(pkt, []byte("ping")...))
+	client.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := client.Read(buf); err == nil {
+		t.Fatalf("expected relay to be closed")
+	}
+}
+
+func TestUDPNatEntry_Idle(t *testing.T) {
+	e := &udpNatEntry{}
+	e.touch()
+	if e.idle(time.Minute) {
+		t.Fatalf("expected active entry")
+	}
+	if !e.idle(0) {
+		t.Fatalf("expected idle entry")
+	}
+}
+
+// blockingResolver blocks until the context is done
+type blockingResolver struct{}
+
+func (blockingResolver) Resolve(ctx context.Context, _ string) (context.Context, []net.IP, error) {
+	<-ctx.Done()
+	return ctx, nil, ctx.Err()
+}
+
+// countingDeny denies the port and counts the evaluations
+type countingDeny struct {
+	port  int
+	calls atomic.Int32
+}
+
+func (d *countingDeny) Allow(ctx context.Context, req *Request) (context.Context, bool) {
+	d.calls.Add(1)
+	return ctx, req.DestAddr.Port != d.port
+}
+
+func TestUDPAssociation_NatEntry(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	rules := &countingDeny{port: 9}
+	s, _ := New(ctx, testLogger(t), &Config{Rules: rules, Resolver: blockingResolver{}, UDPMaxDestinations: 2})
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	a := newUDPAssociation(ctx, s, &Request{Lg: testLogger(t), DestAddr: &AddrSpec{}}, nil, relay)
+	defer a.close()
+	pending := func() int {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		return len(a.pending)
+	}
+
+	// A slow lookup does not block the relay, the datagrams are queued
+	slow := &AddrSpec{FQDN: "slow.example", Port: 53}
+	for i := 0; i < udpPendingPackets; i++ {
+		if entry, err := a.natEntry(slow, []byte("ping")); entry != nil || err != nil {
+			t.Fatalf("bad: %v %v", entry, err)
+		}
+	}
+	if _, err := a.natEntry(slow, []byte("ping")); err == nil {
+		t.Fatalf("expected full queue")
+	}
+
+	// A denied destination is cached without evaluating the rules again
+	denied := &AddrSpec{IP: net.IPv4(127, 0, 0, 1), Port: 9}
+	a.natEntry(denied, nil)
+	for pending() > 1 {
+		time.Sleep(time.Millisecond)
+	}
+	calls := rules.calls.Load()
+	if _, err := a.natEntry(denied, nil); err == nil || rules.calls.Load() != calls {
+		t.Fatalf("bad: %v, %v rule calls", err, rules.calls.Load())
+	}
+
+	// The pending and open destinations are limited
+	if _, err := a.natEntry(&AddrSpec{IP: net.IPv4(127, 0, 0, 1), Port: 10}, nil); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := a.natEntry(&AddrSpec{IP: net.IPv4(127, 0, 0, 1), Port: 11}, nil); err == nil {
+		t.Fatalf("expected destination limit")
+	}
+}
+
+// nameRewriter rewrites destinations to the name
+type nameRewriter string
+
+func (n nameRewriter) Rewrite(ctx context.Context, req *Request) (context.Context, *AddrSpec) {
+	return ctx, &AddrSpec{FQDN: string(n), Port: req.DestAddr.Port}
+}
+
+// denyRealIP denies the actual destination ip
+type denyRealIP string
+
+func (d denyRealIP) Allow(ctx context.Context, req *Request) (context.Context, bool) {
+	return ctx, req.Phase != Final || !req.RealDestAddr().IP.Equal(net.ParseIP(string(d)))
+}
+
+func TestUDPAssociation_RewriteToName(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for _, tc := range []struct {
+		name     string
+		resolver NameResolver
+		expected string
+	}{
+		{"resolved", &countingResolver{ips: []net.IP{net.IPv4(127, 0, 0, 1)}}, "127.0.0.1:9"},
+		{"denied after resolution", &countingResolver{ips: []net.IP{net.IPv4(127, 0, 0, 2)}}, ""},
+		{"lookup failure", failResolver{}, ""},
+	} {
+		s, _ := New(ctx, testLogger(t), &Config{Rules: denyRealIP("127.0.0.2"), Resolver: tc.resolver, Rewriter: nameRewriter("udp.example")})
+		a := newUDPAssociation(ctx, s, &Request{Lg: testLogger(t), DestAddr: &AddrSpec{}}, nil, nil)
+		conn, dest, err := a.dial(&AddrSpec{IP: net.IPv4(192, 0, 2, 1), Port: 9})
+		if tc.expected == "" {
+			if err == nil {
+				conn.Close()
+				t.Errorf("%v: expected error", tc.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%v: err: %v", tc.name, err)
+		}
+		conn.Close()
+		if conn.RemoteAddr().String() != tc.expected || dest.FQDN != "udp.example" {
+			t.Errorf("%v: bad: %v %v", tc.name, conn.RemoteAddr(), dest)
+		}
+	}
+}
@@ -1,13 +1,18 @@
 package socks5
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
 	"fmt"
+	"github.com/google/uuid"
 	"io"
+	"net"
 )
 
 const (
 	NoAuth          = uint8(0)
-	noAcceptable    = uint8(255)
+	NoAcceptable    = uint8(255)
 	UserPassAuth    = uint8(2)
 	userAuthVersion = uint8(1)
 	authSuccess     = uint8(0)
@@ -23,21 +28,72 @@ type CredentialStore interface {
 	Valid(user, password string) bool
 }
 
+// AttributeStore can be implemented by a CredentialStore to add attributes
+// of authenticated users to AuthContext.Payload, e.g. ldap groups matched by rules.
+// Username is not overridden.
+type AttributeStore interface {
+	Attributes(user string) map[string]string
+}
+
+// ConnCredentialStore can be implemented by a CredentialStore to validate
+// credentials with the client connection info, e.g. to restrict users by source address.
+// If implemented, ValidConn is called instead of Valid.
+type ConnCredentialStore interface {
+	ValidConn(ctx context.Context, info *ConnInfo, user, password string) bool
+}
+
+// ConnInfo describes the client connection being authenticated
+type ConnInfo struct {
+	// ID of the connection, logged as connId
+	ID uuid.UUID
+	// Listener is the name of the listener which accepted the connection
+	Listener string
+	// RemoteAddr is the client address
+	RemoteAddr net.Addr
+	// LocalAddr is the server address the client connected to
+	LocalAddr net.Addr
+	// TLS is the state of the tls session, nil for plain connections
+	TLS *tls.ConnectionState
+}
+
 // AuthContext encapsulates authentication state provided during negotiation
 type AuthContext struct {
 	// Provided auth method
 	Method uint8
 	// Payload provided during negotiation.
 	// Keys depend on the used auth method.
-	// For UserPassAuth contains Username
+	// For UserPassAuth contains Username.
+	// For SOCKS4 requests contains UserId
 	Payload map[string]string
 }
 
+// Authenticator runs the subnegotiation of an auth method. It returns the auth context
+// and the username logged with the requests.
 type Authenticator interface {
+	Authenticate(ctx context.Context, info *ConnInfo, reader io.Reader, writer io.Writer) (*AuthContext, string, error)
+	GetCode() uint8
+}
+
+// LegacyAuthenticator is an Authenticator without the context and the connection info.
+// Use AdaptAuthenticator to register it in Config.AuthMethods.
+type LegacyAuthenticator interface {
 	Authenticate(reader io.Reader, writer io.Writer) (*AuthContext, string, error)
 	GetCode() uint8
 }
 
+// AdaptAuthenticator converts a LegacyAuthenticator to an Authenticator
+func AdaptAuthenticator(a LegacyAuthenticator) Authenticator {
+	return legacyAuthenticator{a}
+}
+
+type legacyAuthenticator struct {
+	LegacyAuthenticator
+}
+
+func (a legacyAuthenticator) Authenticate(_ context.Context, _ *ConnInfo, reader io.Reader, writer io.Writer) (*AuthContext, string, error) {
+	return a.LegacyAuthenticator.Authenticate(reader, writer)
+}
+
 // NoAuthAuthenticator is used to handle the "No Authentication" mode
 type NoAuthAuthenticator struct{}
 
@@ -45,7 +101,7 @@ func (a NoAuthAuthenticator) GetCode() uint8 {
 	return NoAuth
 }
 
-func (a NoAuthAuthenticator) Authenticate(_ io.Reader, writer io.Writer) (*AuthContext, string, error) {
+func (a NoAuthAuthenticator) Authenticate(_ context.Context, _ *ConnInfo, _ io.Reader, writer io.Writer) (*AuthContext, string, error) {
 	_, err := writer.Write([]byte{socks5Version, NoAuth})
 	return &AuthContext{NoAuth, nil}, "", err
 }
@@ -60,7 +116,7 @@ func (a UserPassAuthenticator) GetCode() uint8 {
 	return UserPassAuth
 }
 
-func (a UserPassAuthenticator) Authenticate(reader io.Reader, writer io.Writer) (*AuthContext, string, error) {
+func (a UserPassAuthenticator) Authenticate(ctx context.Context, info *ConnInfo, reader io.Reader, writer io.Writer) (*AuthContext, string, error) {
 	// Tell the client to use user/pass auth
 	if _, err := writer.Write([]byte{socks5Version, UserPassAuth}); err != nil {
 		return nil, "", err
@@ -97,7 +153,7 @@ func (a UserPassAuthenticator) Authenticate(reader io.Reader, writer io.Writer)
 	}
 
 	// Verify the password
-	if a.Credentials.Valid(string(user), string(pass)) {
+	if validCredentials(ctx, a.Credentials, info, string(user), string(pass)) {
 		if _, err := writer.Write([]byte{userAuthVersion, authSuccess}); err != nil {
 			return nil, "", err
 		}
@@ -109,33 +165,111 @@ func (a UserPassAuthenticator) Authenticate(reader io.Reader, writer io.Writer)
 	}
 
 	// Done
-	return &AuthContext{UserPassAuth, map[string]string{"Username": string(user)}}, string(user), nil
+	return &AuthContext{UserPassAuth, userPayload(a.Credentials, string(user))}, string(user), nil
+}
+
+// userPayload returns the auth payload of the user with the attributes of the store
+func userPayload(creds CredentialStore, user string) map[string]string {
+	payload := map[string]string{"Username": user}
+	if store, ok := creds.(AttributeStore); ok {
+		for key, value := range store.Attributes(user) {
+			if key != "Username" {
+				payload[key] = value
+			}
+		}
+	}
+	return payload
+}
+
+// credentials returns the CredentialStore of the user/pass authenticator
+func (s *Server) credentials() CredentialStore {
+	switch a := s.authMethods[UserPassAuth].(type) {
+	case UserPassAuthenticator:
+		return a.Credentials
+	case *UserPassAuthenticator:
+		return a.Credentials
+	}
+	return nil
+}
+
+// validCredentials checks the credentials with the connection info if the store supports it
+func validCredentials(ctx context.Context, creds CredentialStore, info *ConnInfo, user, password string) bool {
+	if c, ok := creds.(ConnCredentialStore); ok {
+		return c.ValidConn(ctx, info, user, password)
+	}
+	return creds.Valid(user, password)
+}
+
+// AuthPolicy restricts the auth methods of clients from the networks
+type AuthPolicy struct {
+	// Networks match the client address
+	Networks []*net.IPNet
+	// Methods are the allowed method codes in preference order
+	Methods []uint8
+}
+
+// clientAuthMethods returns the method codes allowed for the client in preference order.
+// The first auth policy matching the client address applies,
+// otherwise all configured methods are allowed in the Config.AuthMethods order.
+func (s *Server) clientAuthMethods(info *ConnInfo) []uint8 {
+	if info != nil {
+		if client, ok := info.RemoteAddr.(*net.TCPAddr); ok {
+			for _, p := range s.config.AuthPolicies {
+				for _, n := range p.Networks {
+					if n.Contains(client.IP) {
+						return p.Methods
+					}
+				}
+			}
+		}
+	}
+	return s.authOrder
+}
+
+// allowsAuth reports whether the client may use the auth method
+func (s *Server) allowsAuth(info *ConnInfo, method uint8) bool {
+	return bytes.IndexByte(s.clientAuthMethods(info), method) >= 0
+}
+
+// allowsAnonymous reports whether the client may skip authentication,
+// used by SOCKS4 and HTTP requests without credentials. Other authenticators
+// negotiated as NoAuth, e.g. ClientCertAuthenticator, still verify the client,
+// so only NoAuthAuthenticator allows anonymous clients.
+func (s *Server) allowsAnonymous(info *ConnInfo) bool {
+	switch s.authMethods[NoAuth].(type) {
+	case NoAuthAuthenticator, *NoAuthAuthenticator:
+		return s.allowsAuth(info, NoAuth)
+	}
+	return false
 }
 
 // authenticate is used to handle connection authentication
-func (s *Server) authenticate(conn io.Writer, bufConn io.Reader) (*AuthContext, string, error) {
+func (s *Server) authenticate(ctx context.Context, info *ConnInfo, conn io.Writer, bufConn io.Reader) (*AuthContext, string, error) {
 	// Get the methods
 	methods, err := readMethods(bufConn)
 	if err != nil {
 		return nil, "", fmt.Errorf("failed to get auth methods: %v", err)
 	}
 
-	// Select a usable method
-	for _, method := range methods {
-		authMethod, found := s.authMethods[method]
-		if found {
-			return authMethod.Authenticate(bufConn, conn)
+	// Select the most preferred server method offered by the client,
+	// so the client can not downgrade to a weaker one
+	for _, method := range s.clientAuthMethods(info) {
+		if bytes.IndexByte(methods, method) >= 0 {
+			authContext, user, err := s.authMethods[method].Authenticate(ctx, info, bufConn, conn)
+			s.metrics().AuthResult(method, err == nil)
+			return authContext, user, err
 		}
 	}
 
 	// No usable method found
+	s.metrics().AuthResult(NoAcceptable, false)
 	return nil, "", noAcceptableAuth(conn)
 }
 
 // noAcceptableAuth is used to handle when we have no eligible
 // authentication mechanism
 func noAcceptableAuth(conn io.Writer) error {
-	_, _ = conn.Write([]byte{socks5Version, noAcceptable})
+	_, _ = conn.Write([]byte{socks5Version, NoAcceptable})
 	return NoSupportedAuth
 }
 
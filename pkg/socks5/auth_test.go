@@ -2,7 +2,9 @@ package socks5
 
 import (
 	"bytes"
-	"golang.org/x/net/context"
+	"context"
+	"io"
+	"net"
 	"testing"
 )
 
@@ -11,8 +13,8 @@ func TestNoAuth(t *testing.T) {
 	req.Write([]byte{1, NoAuth})
 	var resp bytes.Buffer
 
-	s, _ := New(context.Background(), &Config{})
-	ctx, err := s.authenticate(&resp, req)
+	s, _ := New(context.Background(), testLogger(t), &Config{})
+	ctx, _, err := s.authenticate(context.Background(), &ConnInfo{}, &resp, req)
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
@@ -49,9 +51,9 @@ func TestPasswordAuth_Valid(t *testing.T) {
 
 	cator := UserPassAuthenticator{Credentials: cred}
 
-	s, _ := New(context.Background(), &Config{AuthMethods: []Authenticator{cator}})
+	s, _ := New(context.Background(), testLogger(t), &Config{AuthMethods: []Authenticator{cator}})
 
-	ctx, err := s.authenticate(&resp, req)
+	ctx, _, err := s.authenticate(context.Background(), &ConnInfo{}, &resp, req)
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
@@ -85,9 +87,9 @@ func TestPasswordAuth_Invalid(t *testing.T) {
 		"foo": "bar",
 	}
 	cator := UserPassAuthenticator{Credentials: cred}
-	s, _ := New(context.Background(), &Config{AuthMethods: []Authenticator{cator}})
+	s, _ := New(context.Background(), testLogger(t), &Config{AuthMethods: []Authenticator{cator}})
 
-	ctx, err := s.authenticate(&resp, req)
+	ctx, _, err := s.authenticate(context.Background(), &ConnInfo{}, &resp, req)
 	if err.Error() != "user foo authentication failed" {
 		t.Fatalf("err: %v", err)
 	}
@@ -112,9 +114,9 @@ func TestNoSupportedAuth(t *testing.T) {
 	}
 	cator := UserPassAuthenticator{Credentials: cred}
 
-	s, _ := New(context.Background(), &Config{AuthMethods: []Authenticator{cator}})
+	s, _ := New(context.Background(), testLogger(t), &Config{AuthMethods: []Authenticator{cator}})
 
-	ctx, err := s.authenticate(&resp, req)
+	ctx, _, err := s.authenticate(context.Background(), &ConnInfo{}, &resp, req)
 	if err != NoSupportedAuth {
 		t.Fatalf("err: %v", err)
 	}
@@ -124,7 +126,124 @@ func TestNoSupportedAuth(t *testing.T) {
 	}
 
 	out := resp.Bytes()
-	if !bytes.Equal(out, []byte{socks5Version, noAcceptable}) {
+	if !bytes.Equal(out, []byte{socks5Version, NoAcceptable}) {
 		t.Fatalf("bad: %v", out)
 	}
 }
+
+// sourceCredentials accepts the users only from the network
+type sourceCredentials struct {
+	testCredentials
+	network *net.IPNet
+}
+
+func (s sourceCredentials) ValidConn(_ context.Context, info *ConnInfo, user, password string) bool {
+	addr, ok := info.RemoteAddr.(*net.TCPAddr)
+	return ok && s.network.Contains(addr.IP) && s.Valid(user, password)
+}
+
+func TestPasswordAuth_ConnCredentials(t *testing.T) {
+	_, network, _ := net.ParseCIDR("10.0.0.0/8")
+	cator := UserPassAuthenticator{Credentials: sourceCredentials{testCredentials{"foo": "bar"}, network}}
+	s, _ := New(context.Background(), testLogger(t), &Config{AuthMethods: []Authenticator{cator}})
+
+	for _, tc := range []struct {
+		remote   net.IP
+		expected byte
+	}{
+		{net.IPv4(10, 1, 2, 3), authSuccess},
+		{net.IPv4(192, 0, 2, 1), authFailure},
+	} {
+		req := bytes.NewBuffer([]byte{1, UserPassAuth, 1, 3, 'f', 'o', 'o', 3, 'b', 'a', 'r'})
+		var resp bytes.Buffer
+		info := &ConnInfo{RemoteAddr: &net.TCPAddr{IP: tc.remote, Port: 65432}}
+		_, _, _ = s.authenticate(context.Background(), info, &resp, req)
+		if out := resp.Bytes(); !bytes.Equal(out, []byte{socks5Version, UserPassAuth, 1, tc.expected}) {
+			t.Fatalf("%v: bad: %v", tc.remote, out)
+		}
+	}
+}
+
+// legacyNoAuth implements the Authenticator signature without the connection info
+type legacyNoAuth struct{}
+
+func (legacyNoAuth) GetCode() uint8 {
+	return NoAuth
+}
+
+func (legacyNoAuth) Authenticate(_ io.Reader, writer io.Writer) (*AuthContext, string, error) {
+	_, err := writer.Write([]byte{socks5Version, NoAuth})
+	return &AuthContext{NoAuth, map[string]string{"Username": "legacy"}}, "legacy", err
+}
+
+func TestAdaptAuthenticator(t *testing.T) {
+	req := bytes.NewBuffer([]byte{1, NoAuth})
+	var resp bytes.Buffer
+	s, _ := New(context.Background(), testLogger(t), &Config{AuthMethods: []Authenticator{AdaptAuthenticator(legacyNoAuth{})}})
+
+	ctx, user, err := s.authenticate(context.Background(), &ConnInfo{}, &resp, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if user != "legacy" || ctx.Payload["Username"] != "legacy" {
+		t.Fatalf("bad: %v %v", user, ctx.Payload)
+	}
+	if out := resp.Bytes(); !bytes.Equal(out, []byte{socks5Version, NoAuth}) {
+		t.Fatalf("bad: %v", out)
+	}
+}
+
+func TestAuthPreference(t *testing.T) {
+	req := bytes.NewBuffer([]byte{2, NoAuth, UserPassAuth, 1, 3, 'f', 'o', 'o', 3, 'b', 'a', 'r'})
+	var resp bytes.Buffer
+	cator := UserPassAuthenticator{Credentials: testCredentials{"foo": "bar"}}
+	s, _ := New(context.Background(), testLogger(t), &Config{AuthMethods: []Authenticator{cator, NoAuthAuthenticator{}}})
+
+	// The client prefers no auth, the server wins
+	ctx, _, err := s.authenticate(context.Background(), &ConnInfo{}, &resp, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if ctx.Method != UserPassAuth {
+		t.Fatalf("bad: %v", ctx.Method)
+	}
+}
+
+func TestAuthPolicies(t *testing.T) {
+	_, trusted, _ := net.ParseCIDR("10.0.0.0/8")
+	_, all, _ := net.ParseCIDR("0.0.0.0/0")
+	cator := UserPassAuthenticator{Credentials: testCredentials{"foo": "bar"}}
+	s, err := New(context.Background(), testLogger(t), &Config{
+		AuthMethods: []Authenticator{NoAuthAuthenticator{}, cator},
+		AuthPolicies: []AuthPolicy{
+			{Networks: []*net.IPNet{trusted}, Methods: []uint8{NoAuth, UserPassAuth}},
+			{Networks: []*net.IPNet{all}, Methods: []uint8{UserPassAuth}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	for _, tc := range []struct {
+		remote   net.IP
+		methods  []byte
+		expected []byte
+	}{
+		{net.IPv4(10, 1, 2, 3), []byte{1, NoAuth}, []byte{socks5Version, NoAuth}},
+		{net.IPv4(192, 0, 2, 1), []byte{1, NoAuth}, []byte{socks5Version, NoAcceptable}},
+		{net.IPv4(192, 0, 2, 1), []byte{2, NoAuth, UserPassAuth, 1, 3, 'f', 'o', 'o', 3, 'b', 'a', 'r'}, []byte{socks5Version, UserPassAuth, 1, authSuccess}},
+	} {
+		var resp bytes.Buffer
+		info := &ConnInfo{RemoteAddr: &net.TCPAddr{IP: tc.remote, Port: 65432}}
+		_, _, _ = s.authenticate(context.Background(), info, &resp, bytes.NewBuffer(tc.methods))
+		if out := resp.Bytes(); !bytes.Equal(out, tc.expected) {
+			t.Fatalf("%v: bad: %v", tc.remote, out)
+		}
+	}
+
+	if _, err := New(context.Background(), testLogger(t), &Config{
+		AuthPolicies: []AuthPolicy{{Networks: []*net.IPNet{all}, Methods: []uint8{UserPassAuth}}},
+	}); err == nil {
+		t.Fatalf("expected error")
+	}
+}
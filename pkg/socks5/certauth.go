@@ -0,0 +1,127 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"strings"
+	"text/template"
+)
+
+// ClientCertAuthenticator is used to authenticate clients by the tls client certificate.
+// It is negotiated as "No Authentication" over an already established tls session,
+// so the server tls config has to request client certificates.
+type ClientCertAuthenticator struct {
+	// Roots are used to verify client certificates
+	Roots *x509.CertPool
+
+	// Username maps the verified certificate to the username.
+	// Defaults to CertCommonName.
+	Username func(cert *x509.Certificate) (string, error)
+}
+
+func (a ClientCertAuthenticator) GetCode() uint8 {
+	return NoAuth
+}
+
+func (a ClientCertAuthenticator) Authenticate(_ context.Context, info *ConnInfo, _ io.Reader, writer io.Writer) (*AuthContext, string, error) {
+	// The certificate is taken from the tls session of the client connection
+	if info == nil || info.TLS == nil {
+		_, _ = writer.Write([]byte{socks5Version, NoAcceptable})
+		return nil, "", fmt.Errorf("client certificate authentication requires tls")
+	}
+	state := info.TLS
+	if len(state.PeerCertificates) == 0 {
+		_, _ = writer.Write([]byte{socks5Version, NoAcceptable})
+		return nil, "", fmt.Errorf("client certificate is not provided")
+	}
+
+	// Verify the certificate chain
+	cert := state.PeerCertificates[0]
+	intermediates := x509.NewCertPool()
+	for _, c := range state.PeerCertificates[1:] {
+		intermediates.AddCert(c)
+	}
+	opts := x509.VerifyOptions{
+		Roots:         a.Roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if _, err := cert.Verify(opts); err != nil {
+		_, _ = writer.Write([]byte{socks5Version, NoAcceptable})
+		return nil, "", fmt.Errorf("client certificate %v verification failed: %v", cert.Subject, err)
+	}
+
+	// Map the certificate to the username
+	username := a.Username
+	if username == nil {
+		username = CertCommonName
+	}
+	user, err := username(cert)
+	if err != nil {
+		_, _ = writer.Write([]byte{socks5Version, NoAcceptable})
+		return nil, "", fmt.Errorf("failed to get username from client certificate %v: %v", cert.Subject, err)
+	}
+
+	if _, err := writer.Write([]byte{socks5Version, NoAuth}); err != nil {
+		return nil, "", err
+	}
+	return &AuthContext{NoAuth, certPayload(user, cert)}, user, nil
+}
+
+// certPayload returns the certificate fields exposed to rules
+func certPayload(user string, cert *x509.Certificate) map[string]string {
+	return map[string]string{
+		"Username":   user,
+		"CommonName": cert.Subject.CommonName,
+		"Serial":     cert.SerialNumber.String(),
+		"OU":         strings.Join(cert.Subject.OrganizationalUnit, ","),
+		"O":          strings.Join(cert.Subject.Organization, ","),
+		"Issuer":     cert.Issuer.CommonName,
+		"DNSNames":   strings.Join(cert.DNSNames, ","),
+		"Emails":     strings.Join(cert.EmailAddresses, ","),
+	}
+}
+
+// CertCommonName maps the certificate to the subject common name
+func CertCommonName(cert *x509.Certificate) (string, error) {
+	if cert.Subject.CommonName == "" {
+		return "", fmt.Errorf("empty subject common name")
+	}
+	return cert.Subject.CommonName, nil
+}
+
+// CertSAN maps the certificate to the first subject alternative name:
+// dns name, email or uri
+func CertSAN(cert *x509.Certificate) (string, error) {
+	switch {
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0], nil
+	case len(cert.EmailAddresses) > 0:
+		return cert.EmailAddresses[0], nil
+	case len(cert.URIs) > 0:
+		return cert.URIs[0].String(), nil
+	}
+	return "", fmt.Errorf("no subject alternative name")
+}
+
+// CertTemplate maps the certificate to the username with a text/template
+// executed on x509.Certificate. Example: {{.Subject.CommonName}}
+func CertTemplate(text string) (func(cert *x509.Certificate) (string, error), error) {
+	tmpl, err := template.New("username").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse username template: %v", err)
+	}
+	return func(cert *x509.Certificate) (string, error) {
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, cert); err != nil {
+			return "", err
+		}
+		if buf.Len() == 0 {
+			return "", fmt.Errorf("username template returns empty result")
+		}
+		return buf.String(), nil
+	}, nil
+}
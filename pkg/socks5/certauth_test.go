@@ -0,0 +1,178 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+type payloadRule map[string]string
+
+func (p payloadRule) Allow(ctx context.Context, req *Request) (context.Context, bool) {
+	for k, v := range p {
+		if req.AuthContext.Payload[k] != v {
+			return ctx, false
+		}
+	}
+	return ctx, true
+}
+
+func TestClientCertAuthenticator(t *testing.T) {
+	ca := testTLSCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "test ca"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+	serverCert := testTLSCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "localhost"},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, &ca)
+	clientCert := testTLSCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "machine1", OrganizationalUnit: []string{"build"}},
+		DNSNames:    []string{"machine1.example.com"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, &ca)
+	selfSigned := testTLSCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "machine1", OrganizationalUnit: []string{"build"}},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, nil)
+
+	// Create a local listener
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer target.Close()
+	tAddr := target.Addr().(*net.TCPAddr)
+
+	// Create a socks server which allows the build OU only
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	username, err := CertTemplate("{{.Subject.CommonName}}@{{index .Subject.OrganizationalUnit 0}}")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	serv, err := New(ctx, testLogger(t), &Config{
+		AuthMethods: []Authenticator{ClientCertAuthenticator{Roots: roots, Username: username}},
+		Rules:       payloadRule{"Username": "machine1@build", "OU": "build"},
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	go func() {
+		_ = serv.ServeListener(tls.NewListener(l, &tls.Config{
+			Certificates: []tls.Certificate{serverCert},
+			ClientAuth:   tls.RequestClientCert,
+		}))
+	}()
+
+	for _, tc := range []struct {
+		name     string
+		certs    []tls.Certificate
+		expected []byte
+	}{
+		{"valid", []tls.Certificate{clientCert}, []byte{socks5Version, NoAuth, 5, SuccessReply}},
+		{"untrusted", []tls.Certificate{selfSigned}, []byte{socks5Version, NoAcceptable}},
+		{"missing", nil, []byte{socks5Version, NoAcceptable}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{RootCAs: roots, Certificates: tc.certs})
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(time.Second))
+
+			req := []byte{5, 1, NoAuth, 5, 1, 0, 1, 127, 0, 0, 1, 0, 0}
+			binary.BigEndian.PutUint16(req[11:], uint16(tAddr.Port))
+			conn.Write(req)
+			out := make([]byte, len(tc.expected))
+			if _, err := io.ReadAtLeast(conn, out, len(out)); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			if !bytes.Equal(out, tc.expected) {
+				t.Fatalf("bad: %v", out)
+			}
+		})
+	}
+}
+
+func TestClientCertAuthenticator_RequiresTLS(t *testing.T) {
+	var resp bytes.Buffer
+	if _, _, err := (ClientCertAuthenticator{}).Authenticate(context.Background(), &ConnInfo{}, nil, &resp); err == nil {
+		t.Fatalf("expected error")
+	}
+	if !bytes.Equal(resp.Bytes(), []byte{socks5Version, NoAcceptable}) {
+		t.Fatalf("bad: %v", resp.Bytes())
+	}
+}
+
+func TestCertSAN(t *testing.T) {
+	user, err := CertSAN(&x509.Certificate{EmailAddresses: []string{"user@example.com"}})
+	if err != nil || user != "user@example.com" {
+		t.Fatalf("bad: %v %v", user, err)
+	}
+	if _, err := CertSAN(&x509.Certificate{}); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestClientCertAuthenticator_NoAnonymous(t *testing.T) {
+	// Create a local listener
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer target.Close()
+	tAddr := target.Addr().(*net.TCPAddr)
+	conf := &Config{AuthMethods: []Authenticator{ClientCertAuthenticator{Roots: x509.NewCertPool()}}}
+
+	// SOCKS4 has no client certificate check, so it is refused
+	s, err := New(context.Background(), testLogger(t), conf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		_ = s.ServeConnection(Connection{Lg: testLogger(t), conn: server})
+	}()
+	client.SetDeadline(time.Now().Add(time.Second))
+	req := []byte{socks4Version, ConnectCommand, 0, 0, 127, 0, 0, 1, 0}
+	binary.BigEndian.PutUint16(req[2:], uint16(tAddr.Port))
+	client.Write(req)
+	out := make([]byte, 8)
+	if _, err := io.ReadAtLeast(client, out, len(out)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out[1] != socks4Rejected {
+		t.Fatalf("bad: %v", out)
+	}
+
+	// HTTP requests without credentials are refused
+	proxyAddr := newHTTPProxy(t, conf)
+	resp, err := httpProxyClient(proxyAddr, nil, nil).Get("http://" + tAddr.String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusProxyAuthRequired {
+		t.Fatalf("bad: %v", resp.Status)
+	}
+}
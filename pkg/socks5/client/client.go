@@ -0,0 +1,380 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/dossif/gosocks5/pkg/socks5"
+	"golang.org/x/net/proxy"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	socks5Version    = uint8(5)
+	userAuthVersion  = uint8(1)
+	tokenAuthVersion = uint8(1)
+	authSuccess      = uint8(0)
+)
+
+var (
+	_ proxy.Dialer        = (*Dialer)(nil)
+	_ proxy.ContextDialer = (*Dialer)(nil)
+)
+
+// Dialer is used to dial connections through a SOCKS5 server.
+// DialContext can be used directly as http.Transport.DialContext.
+type Dialer struct {
+	// ProxyAddress of the SOCKS5 server, ip:port
+	ProxyAddress string
+
+	// If provided, username/password authentication is offered
+	// to the server in addition to "auth-less" mode
+	Username string
+	Password string
+
+	// If provided, token authentication with socks5.TokenAuth is offered,
+	// see socks5.TokenAuthenticator
+	Token string
+	// TokenCode is the private method code 0x80-0xfe of the server token auth.
+	// Defaults to socks5.TokenAuth.
+	TokenCode uint8
+
+	// Optional function for dialing the SOCKS5 server.
+	// Defaults to net.Dialer.
+	ProxyDial func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// NewDialer creates a new Dialer for the SOCKS5 server at addr
+func NewDialer(addr, user, pass string) *Dialer {
+	return &Dialer{
+		ProxyAddress: addr,
+		Username:     user,
+		Password:     pass,
+	}
+}
+
+// Dial connects to addr through the SOCKS5 server
+func (d *Dialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// DialContext connects to addr through the SOCKS5 server using the CONNECT command.
+// The context covers both the connection to the server and the negotiation.
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("unsupported network %v", network)
+	}
+	dest, err := parseAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, _, err := d.command(ctx, socks5.ConnectCommand, dest)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Bind asks the SOCKS5 server to accept a single connection from addr.
+// The returned Bind reports the address the peer has to connect to.
+func (d *Dialer) Bind(ctx context.Context, addr string) (*Bind, error) {
+	dest, err := parseAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, bound, err := d.command(ctx, socks5.BindCommand, dest)
+	if err != nil {
+		return nil, err
+	}
+	return &Bind{conn: conn, Addr: bound}, nil
+}
+
+// Associate asks the SOCKS5 server to relay udp datagrams.
+// The association lives until the returned UDPConn is closed.
+func (d *Dialer) Associate(ctx context.Context) (*UDPConn, error) {
+	local, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen udp: %v", err)
+	}
+	ctrl, relay, err := d.command(ctx, socks5.AssociateCommand, &socks5.AddrSpec{IP: net.IPv4zero})
+	if err != nil {
+		_ = local.Close()
+		return nil, err
+	}
+
+	// The server may reply with an unspecified address, use the server ip then
+	if len(relay.IP) == 0 || relay.IP.IsUnspecified() {
+		if server, ok := ctrl.RemoteAddr().(*net.TCPAddr); ok {
+			relay = &socks5.AddrSpec{IP: server.IP, Port: relay.Port}
+		}
+	}
+	return &UDPConn{
+		ctrl:  ctrl,
+		conn:  local,
+		relay: &net.UDPAddr{IP: relay.IP, Port: relay.Port},
+	}, nil
+}
+
+// command connects to the server, negotiates authentication and sends the request.
+// Returns the connection and the address from the server reply.
+func (d *Dialer) command(ctx context.Context, cmd uint8, dest *socks5.AddrSpec) (net.Conn, *socks5.AddrSpec, error) {
+	dial := d.ProxyDial
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	conn, err := dial(ctx, "tcp", d.ProxyAddress)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to connect to socks5 server %v: %w", d.ProxyAddress, err)
+	}
+
+	var bound *socks5.AddrSpec
+	err = Negotiate(ctx, conn, func() error {
+		bound, err = d.negotiate(conn, cmd, dest)
+		return err
+	})
+	if err != nil {
+		_ = conn.Close()
+		return nil, nil, err
+	}
+	return conn, bound, nil
+}
+
+// Negotiate runs the negotiation fn on conn and aborts it when ctx is done.
+// If the negotiation fails because of ctx, the context error is returned.
+// The conn deadline is cleared after a successful negotiation.
+func Negotiate(ctx context.Context, conn net.Conn, fn func() error) error {
+	deadline, hasDeadline := ctx.Deadline()
+	if hasDeadline {
+		_ = conn.SetDeadline(deadline)
+	}
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.SetDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+
+	err := fn()
+	close(done)
+	if err != nil {
+		// The conn deadline can expire before the context timer marks ctx done
+		if hasDeadline && !time.Now().Before(deadline) {
+			<-ctx.Done()
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return nil
+}
+
+// negotiate is used to authenticate and send the request
+func (d *Dialer) negotiate(conn net.Conn, cmd uint8, dest *socks5.AddrSpec) (*socks5.AddrSpec, error) {
+	if err := d.authenticate(conn); err != nil {
+		return nil, fmt.Errorf("failed to authenticate: %w", err)
+	}
+
+	// Send the request
+	msg, err := socks5.AppendAddrSpec([]byte{socks5Version, cmd, 0}, dest)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(msg); err != nil {
+		return nil, fmt.Errorf("failed to send request: %v", err)
+	}
+	return socks5.ReadReply(conn)
+}
+
+// authenticate offers the supported methods and handles the selected one
+func (d *Dialer) authenticate(conn net.Conn) error {
+	methods := []byte{socks5.NoAuth}
+	if d.Username != "" {
+		methods = append(methods, socks5.UserPassAuth)
+	}
+	if d.Token != "" {
+		if d.TokenCode != 0 && (d.TokenCode < socks5.TokenAuth || d.TokenCode == socks5.NoAcceptable) {
+			return fmt.Errorf("token method %#x is not a private method code", d.TokenCode)
+		}
+		methods = append(methods, d.tokenCode())
+	}
+	if _, err := conn.Write(append([]byte{socks5Version, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+
+	// Read the selected method
+	header := []byte{0, 0}
+	if _, err := io.ReadAtLeast(conn, header, 2); err != nil {
+		return err
+	}
+	if header[0] != socks5Version {
+		return fmt.Errorf("unsupported socks version: %v", header[0])
+	}
+
+	switch header[1] {
+	case socks5.NoAuth:
+		return nil
+	case socks5.UserPassAuth:
+		if d.Username == "" {
+			return fmt.Errorf("server requires username/password")
+		}
+		if len(d.Username) > 255 || len(d.Password) > 255 {
+			return fmt.Errorf("username or password is too long")
+		}
+		msg := []byte{userAuthVersion, byte(len(d.Username))}
+		msg = append(msg, d.Username...)
+		msg = append(msg, byte(len(d.Password)))
+		msg = append(msg, d.Password...)
+		if _, err := conn.Write(msg); err != nil {
+			return err
+		}
+		if _, err := io.ReadAtLeast(conn, header, 2); err != nil {
+			return err
+		}
+		if header[1] != authSuccess {
+			return fmt.Errorf("user %v authentication failed", d.Username)
+		}
+		return nil
+	case d.tokenCode():
+		if d.Token == "" {
+			return fmt.Errorf("server requires token")
+		}
+		if len(d.Token) > 0xffff {
+			return fmt.Errorf("token is too long")
+		}
+		msg := []byte{tokenAuthVersion, 0, 0}
+		binary.BigEndian.PutUint16(msg[1:], uint16(len(d.Token)))
+		msg = append(msg, d.Token...)
+		if _, err := conn.Write(msg); err != nil {
+			return err
+		}
+		if _, err := io.ReadAtLeast(conn, header, 2); err != nil {
+			return err
+		}
+		if header[1] != authSuccess {
+			return fmt.Errorf("token authentication failed")
+		}
+		return nil
+	case socks5.NoAcceptable:
+		return socks5.NoSupportedAuth
+	default:
+		return fmt.Errorf("unsupported auth method: %v", header[1])
+	}
+}
+
+// tokenCode returns the method code of token auth
+func (d *Dialer) tokenCode() uint8 {
+	if d.TokenCode == 0 {
+		return socks5.TokenAuth
+	}
+	return d.TokenCode
+}
+
+// Bind is a pending bind request
+type Bind struct {
+	conn net.Conn
+	// Addr the server listens on for the peer
+	Addr *socks5.AddrSpec
+}
+
+// Accept waits for the peer to connect to the server.
+// Returns the relayed connection and the peer address.
+func (b *Bind) Accept() (net.Conn, *socks5.AddrSpec, error) {
+	peer, err := socks5.ReadReply(b.conn)
+	if err != nil {
+		return nil, nil, err
+	}
+	return b.conn, peer, nil
+}
+
+// Close cancels the bind request
+func (b *Bind) Close() error {
+	return b.conn.Close()
+}
+
+// UDPConn sends and receives datagrams through a SOCKS5 udp relay
+type UDPConn struct {
+	ctrl  net.Conn
+	conn  *net.UDPConn
+	relay *net.UDPAddr
+}
+
+// LocalAddr returns the local udp address
+func (c *UDPConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+// SetDeadline sets the read and write deadlines of the udp socket
+func (c *UDPConn) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
+// WriteTo sends b to addr through the relay
+func (c *UDPConn) WriteTo(b []byte, addr *socks5.AddrSpec) (int, error) {
+	pkt, err := socks5.AppendAddrSpec([]byte{0, 0, 0}, addr)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := c.conn.WriteToUDP(append(pkt, b...), c.relay); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// ReadFrom reads a datagram from the relay.
+// Returns the payload size and the address the datagram came from.
+func (c *UDPConn) ReadFrom(b []byte) (int, *socks5.AddrSpec, error) {
+	buf := make([]byte, 64*1024)
+	for {
+		n, src, err := c.conn.ReadFromUDP(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		if !src.IP.Equal(c.relay.IP) || src.Port != c.relay.Port || n < 4 || buf[2] != 0 {
+			continue
+		}
+		r := bytes.NewReader(buf[3:n])
+		addr, err := socks5.ReadAddrSpec(r)
+		if err != nil {
+			continue
+		}
+		return copy(b, buf[n-r.Len():n]), addr, nil
+	}
+}
+
+// Close terminates the association
+func (c *UDPConn) Close() error {
+	err := c.conn.Close()
+	if cerr := c.ctrl.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// parseAddr is used to convert host:port into AddrSpec
+func parseAddr(addr string) (*socks5.AddrSpec, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 0 || port > 0xffff {
+		return nil, fmt.Errorf("invalid port %v", portStr)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return &socks5.AddrSpec{IP: ip, Port: port}, nil
+	}
+	if len(host) > 255 {
+		return nil, fmt.Errorf("host name is too long: %v", host)
+	}
+	return &socks5.AddrSpec{FQDN: host, Port: port}, nil
+}
@@ -0,0 +1,236 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"github.com/dossif/gosocks5/pkg/logger"
+	"github.com/dossif/gosocks5/pkg/socks5"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type testCredentials map[string]string
+
+func (t testCredentials) Valid(user, password string) bool {
+	pass, ok := t[user]
+	return ok && password == pass
+}
+
+func newTestServer(t *testing.T, conf *socks5.Config) string {
+	lg, err := logger.NewLogger("debug")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	serv, err := socks5.New(ctx, lg, conf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	go func() {
+		_ = serv.ServeListener(l)
+	}()
+	return l.Addr().String()
+}
+
+func TestDialer_HTTPTransport(t *testing.T) {
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("pong"))
+	}))
+	defer web.Close()
+
+	addr := newTestServer(t, &socks5.Config{Credentials: testCredentials{"foo": "bar"}})
+	d := NewDialer(addr, "foo", "bar")
+	client := &http.Client{Transport: &http.Transport{DialContext: d.DialContext}}
+
+	resp, err := client.Get(web.URL)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "pong" {
+		t.Fatalf("bad: %s", body)
+	}
+}
+
+func TestDialer_AuthFailure(t *testing.T) {
+	addr := newTestServer(t, &socks5.Config{Credentials: testCredentials{"foo": "bar"}})
+
+	if _, err := NewDialer(addr, "", "").Dial("tcp", "127.0.0.1:80"); !errors.Is(err, socks5.NoSupportedAuth) {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestDialer_ReplyError(t *testing.T) {
+	addr := newTestServer(t, &socks5.Config{Rules: socks5.PermitNone()})
+
+	_, err := NewDialer(addr, "", "").Dial("tcp", "127.0.0.1:80")
+	var replyErr *socks5.ReplyError
+	if !errors.As(err, &replyErr) || replyErr.Code != socks5.RuleFailure {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestDialer_ContextCancel(t *testing.T) {
+	// A server which never answers
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			defer conn.Close()
+			_, _ = io.Copy(io.Discard, conn)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := NewDialer(l.Addr().String(), "", "").DialContext(ctx, "tcp", "127.0.0.1:80"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestDialer_Bind(t *testing.T) {
+	addr := newTestServer(t, &socks5.Config{BindIP: net.IPv4(127, 0, 0, 1)})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	b, err := NewDialer(addr, "", "").Bind(ctx, "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer b.Close()
+
+	peer, err := net.Dial("tcp", b.Addr.Address())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer peer.Close()
+	peer.Write([]byte("ping"))
+
+	conn, peerAddr, err := b.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if peerAddr.Port != peer.LocalAddr().(*net.TCPAddr).Port {
+		t.Fatalf("bad: %v", peerAddr)
+	}
+	buf := make([]byte, 4)
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadAtLeast(conn, buf, 4); err != nil || string(buf) != "ping" {
+		t.Fatalf("bad: %s %v", buf, err)
+	}
+}
+
+func TestDialer_Associate(t *testing.T) {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, src, err := echo.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			_, _ = echo.WriteToUDP(buf[:n], src)
+		}
+	}()
+	echoAddr := echo.LocalAddr().(*net.UDPAddr)
+
+	addr := newTestServer(t, &socks5.Config{})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	conn, err := NewDialer(addr, "", "").Associate(ctx)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+
+	dest := &socks5.AddrSpec{IP: echoAddr.IP, Port: echoAddr.Port}
+	if _, err := conn.WriteTo([]byte("ping"), dest); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	buf := make([]byte, 1024)
+	n, from, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(buf[:n]) != "ping" || from.Port != echoAddr.Port {
+		t.Fatalf("bad: %s %v", buf[:n], from)
+	}
+}
+
+func TestParseAddr(t *testing.T) {
+	if a, err := parseAddr("example.com:443"); err != nil || a.FQDN != "example.com" || a.Port != 443 {
+		t.Fatalf("bad: %v %v", a, err)
+	}
+	if a, err := parseAddr("[::1]:80"); err != nil || !a.IP.Equal(net.IPv6loopback) {
+		t.Fatalf("bad: %v %v", a, err)
+	}
+	if _, err := parseAddr("example.com:http"); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestDialer_Token(t *testing.T) {
+	key := []byte("secret")
+	addr := newTestServer(t, &socks5.Config{
+		AuthMethods: []socks5.Authenticator{socks5.TokenAuthenticator{Keys: map[string][]byte{"k1": key}}},
+		Rules:       socks5.PermitNone(),
+	})
+	token, err := socks5.SignToken("k1", key, map[string]interface{}{"sub": "ci", "exp": time.Now().Add(time.Minute).Unix()})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Authenticated requests reach the rules
+	_, err = (&Dialer{ProxyAddress: addr, Token: token}).Dial("tcp", "127.0.0.1:80")
+	var replyErr *socks5.ReplyError
+	if !errors.As(err, &replyErr) || replyErr.Code != socks5.RuleFailure {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := (&Dialer{ProxyAddress: addr, Token: token + "x"}).Dial("tcp", "127.0.0.1:80"); err == nil || errors.As(err, &replyErr) {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestDialer_TokenCode(t *testing.T) {
+	key := []byte("secret")
+	addr := newTestServer(t, &socks5.Config{
+		AuthMethods: []socks5.Authenticator{socks5.TokenAuthenticator{Code: 0x90, Keys: map[string][]byte{"k1": key}}},
+		Rules:       socks5.PermitNone(),
+	})
+	token, err := socks5.SignToken("k1", key, map[string]interface{}{"sub": "ci", "exp": time.Now().Add(time.Minute).Unix()})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	_, err = (&Dialer{ProxyAddress: addr, Token: token, TokenCode: 0x90}).Dial("tcp", "127.0.0.1:80")
+	var replyErr *socks5.ReplyError
+	if !errors.As(err, &replyErr) || replyErr.Code != socks5.RuleFailure {
+		t.Fatalf("err: %v", err)
+	}
+	// The default code is not accepted by the server
+	if _, err := (&Dialer{ProxyAddress: addr, Token: token}).Dial("tcp", "127.0.0.1:80"); !errors.Is(err, socks5.NoSupportedAuth) {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := (&Dialer{ProxyAddress: addr, Token: token, TokenCode: socks5.UserPassAuth}).Dial("tcp", "127.0.0.1:80"); err == nil {
+		t.Fatalf("expected error")
+	}
+}
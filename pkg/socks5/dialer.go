@@ -0,0 +1,179 @@
+package socks5
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultDialTimeout   = time.Second * 10
+	defaultFallbackDelay = time.Millisecond * 250
+)
+
+// FamilyPreference selects the address family dialed first
+// when the destination resolves to both IPv4 and IPv6
+type FamilyPreference uint8
+
+const (
+	// PreferIPv6 starts with IPv6 as recommended by RFC 8305
+	PreferIPv6 FamilyPreference = iota
+	// PreferIPv4 starts with IPv4
+	PreferIPv4
+	// IPv4Only skips IPv6 addresses
+	IPv4Only
+	// IPv6Only skips IPv4 addresses
+	IPv6Only
+)
+
+func (f FamilyPreference) String() string {
+	switch f {
+	case PreferIPv6:
+		return "prefer-ipv6"
+	case PreferIPv4:
+		return "prefer-ipv4"
+	case IPv4Only:
+		return "ipv4-only"
+	case IPv6Only:
+		return "ipv6-only"
+	}
+	return fmt.Sprintf("unknown family preference %d", uint8(f))
+}
+
+// sortAddrs filters the addresses by the family preference and interleaves
+// the families, starting with the preferred one, as in RFC 8305 section 4
+func sortAddrs(addrs []net.IP, pref FamilyPreference) []net.IP {
+	var v4, v6 []net.IP
+	for _, ip := range addrs {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	first, second := v6, v4
+	switch pref {
+	case PreferIPv4:
+		first, second = v4, v6
+	case IPv4Only:
+		first, second = v4, nil
+	case IPv6Only:
+		first, second = v6, nil
+	}
+	sorted := make([]net.IP, 0, len(first)+len(second))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			sorted = append(sorted, first[i])
+		}
+		if i < len(second) {
+			sorted = append(sorted, second[i])
+		}
+	}
+	return sorted
+}
+
+// dialResult is the outcome of a single connection attempt
+type dialResult struct {
+	conn net.Conn
+	err  error
+}
+
+// dialRequest connects to the actual destination of the request
+// and observes the dial latency
+func (s *Server) dialRequest(ctx context.Context, network string, req *Request) (net.Conn, error) {
+	start := time.Now()
+	conn, err := s.dialAddrs(ctx, network, req)
+	s.metrics().Dialed(time.Since(start), err)
+	return conn, err
+}
+
+// dialAddrs dials the actual destination of the request.
+// If the destination was resolved to several addresses and not rewritten,
+// the addresses are raced with staggered attempts as in RFC 8305.
+func (s *Server) dialAddrs(ctx context.Context, network string, req *Request) (net.Conn, error) {
+	addrs := req.destIPs
+	if req.realDestAddr != req.DestAddr || len(addrs) == 0 {
+		if len(req.realDestAddr.IP) == 0 {
+			return s.dialAttempt(ctx, network, req.realDestAddr.Address())
+		}
+		addrs = []net.IP{req.realDestAddr.IP}
+	}
+	port := strconv.Itoa(req.realDestAddr.Port)
+	if len(addrs) == 1 {
+		return s.dialAttempt(ctx, network, net.JoinHostPort(addrs[0].String(), port))
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan dialResult)
+	start := func(ip net.IP) {
+		go func() {
+			conn, err := s.dialAttempt(ctx, network, net.JoinHostPort(ip.String(), port))
+			select {
+			case results <- dialResult{conn, err}:
+			case <-ctx.Done():
+				if conn != nil {
+					_ = conn.Close()
+				}
+			}
+		}()
+	}
+
+	var firstErr error
+	next, pending := 0, 0
+	delay := time.NewTimer(0)
+	defer delay.Stop()
+	for next < len(addrs) || pending > 0 {
+		select {
+		case <-delay.C:
+			// Start the next attempt when the previous one is slow
+			if next < len(addrs) {
+				req.Lg.Lg.Trace().Msgf("dial attempt %v to %v", next+1, addrs[next])
+				start(addrs[next])
+				next++
+				pending++
+				delay.Reset(s.config.FallbackDelay)
+			}
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				return res.conn, nil
+			}
+			req.Lg.Lg.Debug().Msgf("dial attempt failed: %v", res.err)
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			// Start the next attempt right away on failure
+			if next < len(addrs) {
+				if !delay.Stop() {
+					<-delay.C
+				}
+				delay.Reset(0)
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return nil, firstErr
+}
+
+// dial is used to connect to the destination with Config.Dial
+func (s *Server) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	if s.config.Dial != nil {
+		return s.config.Dial(ctx, network, addr)
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, network, addr)
+}
+
+// dialAttempt is a single connection attempt limited by Config.DialTimeout
+func (s *Server) dialAttempt(ctx context.Context, network, addr string) (net.Conn, error) {
+	if s.config.DialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.config.DialTimeout)
+		defer cancel()
+	}
+	return s.dial(ctx, network, addr)
+}
@@ -0,0 +1,85 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSortAddrs(t *testing.T) {
+	v4a, v4b := net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2")
+	v6a, v6b := net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")
+	addrs := []net.IP{v4a, v4b, v6a, v6b}
+
+	for _, tc := range []struct {
+		pref     FamilyPreference
+		expected []net.IP
+	}{
+		{PreferIPv6, []net.IP{v6a, v4a, v6b, v4b}},
+		{PreferIPv4, []net.IP{v4a, v6a, v4b, v6b}},
+		{IPv4Only, []net.IP{v4a, v4b}},
+		{IPv6Only, []net.IP{v6a, v6b}},
+	} {
+		if sorted := sortAddrs(addrs, tc.pref); !reflect.DeepEqual(sorted, tc.expected) {
+			t.Errorf("%v: bad: %v", tc.pref, sorted)
+		}
+	}
+}
+
+// fakeDial refuses, hangs or connects depending on the destination ip
+func fakeDial(ctx context.Context, _, addr string) (net.Conn, error) {
+	host, _, _ := net.SplitHostPort(addr)
+	switch host {
+	case "192.0.2.1":
+		return nil, &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}
+	case "192.0.2.2":
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	client, server := net.Pipe()
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	return client, nil
+}
+
+func TestServer_DialRequest(t *testing.T) {
+	refused, hanging, ok := net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2"), net.ParseIP("2001:db8::1")
+
+	for _, tc := range []struct {
+		name  string
+		addrs []net.IP
+		err   error
+	}{
+		{"fallback on failure", []net.IP{refused, ok}, nil},
+		{"fallback on delay", []net.IP{hanging, ok}, nil},
+		{"all failed", []net.IP{refused, hanging}, syscall.ECONNREFUSED},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &Server{config: &Config{
+				Dial:          fakeDial,
+				DialTimeout:   100 * time.Millisecond,
+				FallbackDelay: 10 * time.Millisecond,
+			}}
+			dest := &AddrSpec{FQDN: "example.com", IP: tc.addrs[0], Port: 80}
+			req := &Request{Lg: testLogger(t), DestAddr: dest, realDestAddr: dest, destIPs: tc.addrs}
+
+			conn, err := s.dialRequest(context.Background(), "tcp", req)
+			if tc.err != nil {
+				if !errors.Is(err, tc.err) {
+					t.Fatalf("bad: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			conn.Close()
+		})
+	}
+}
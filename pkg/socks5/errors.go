@@ -0,0 +1,103 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+var (
+	// UnrecognizedAddrType is returned when a request has an unknown address type
+	UnrecognizedAddrType = fmt.Errorf("unrecognized address type")
+	// BlockedByRules is returned when the RuleSet denies a request
+	BlockedByRules = fmt.Errorf("blocked by rules")
+	// UnsupportedCommand is returned when a request has an unknown command
+	UnsupportedCommand = fmt.Errorf("unsupported command")
+	// ConnQuotaExceeded is returned when a connection is over a ConnQuota limit
+	ConnQuotaExceeded = fmt.Errorf("connection quota exceeded")
+	// DataQuotaExceeded is returned when a user has no data left in the DataQuota
+	DataQuotaExceeded = fmt.Errorf("data quota exceeded")
+)
+
+// replyMessages describes reply codes as in RFC 1928
+var replyMessages = map[uint8]string{
+	SuccessReply:         "succeeded",
+	ServerFailure:        "general SOCKS server failure",
+	RuleFailure:          "connection not allowed by ruleset",
+	NetworkUnreachable:   "network unreachable",
+	HostUnreachable:      "host unreachable",
+	ConnectionRefused:    "connection refused",
+	TTLExpired:           "TTL expired",
+	CommandNotSupported:  "command not supported",
+	AddrTypeNotSupported: "address type not supported",
+}
+
+// ReplyError is returned when a SOCKS5 server replies with a failure code
+type ReplyError struct {
+	Code uint8
+}
+
+func (e *ReplyError) Error() string {
+	return fmt.Sprintf("socks5 reply: %v", ReplyMessage(e.Code))
+}
+
+// ResolveError is returned when the destination FQDN cannot be resolved
+type ResolveError struct {
+	Name string
+	Err  error
+}
+
+func (e *ResolveError) Error() string {
+	return fmt.Sprintf("failed to resolve destination '%v': %v", e.Name, e.Err)
+}
+
+func (e *ResolveError) Unwrap() error {
+	return e.Err
+}
+
+// ReplyMessage returns the description of a reply code
+func ReplyMessage(code uint8) string {
+	if msg, ok := replyMessages[code]; ok {
+		return msg
+	}
+	return fmt.Sprintf("unknown code %v", code)
+}
+
+// ReplyCode classifies an error returned by resolving, rules or dialing
+// into the SOCKS5 reply code to send to the client
+func ReplyCode(err error) uint8 {
+	var replyErr *ReplyError
+	var dnsErr *net.DNSError
+	var resolveErr *ResolveError
+	var netErr net.Error
+	switch {
+	case err == nil:
+		return SuccessReply
+	case errors.As(err, &replyErr):
+		return replyErr.Code
+	case errors.Is(err, BlockedByRules), errors.Is(err, ConnQuotaExceeded), errors.Is(err, DataQuotaExceeded):
+		return RuleFailure
+	case errors.Is(err, UnsupportedCommand):
+		return CommandNotSupported
+	case errors.Is(err, UnrecognizedAddrType):
+		return AddrTypeNotSupported
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return NetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.EHOSTDOWN):
+		return HostUnreachable
+	case errors.As(err, &dnsErr) && !dnsErr.IsTimeout:
+		return HostUnreachable
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, syscall.ETIMEDOUT):
+		return TTLExpired
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return TTLExpired
+	case errors.As(err, &resolveErr):
+		return HostUnreachable
+	default:
+		return ServerFailure
+	}
+}
@@ -0,0 +1,33 @@
+package socks5
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestReplyCode(t *testing.T) {
+	for _, tc := range []struct {
+		err      error
+		expected uint8
+	}{
+		{nil, SuccessReply},
+		{fmt.Errorf("connect to x %w", BlockedByRules), RuleFailure},
+		{&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, ConnectionRefused},
+		{&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ENETUNREACH)}, NetworkUnreachable},
+		{&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.EHOSTUNREACH)}, HostUnreachable},
+		{&ResolveError{Name: "example.invalid", Err: &net.DNSError{IsNotFound: true}}, HostUnreachable},
+		{&net.DNSError{IsTimeout: true}, TTLExpired},
+		{fmt.Errorf("dial: %w", context.DeadlineExceeded), TTLExpired},
+		{&ReplyError{Code: CommandNotSupported}, CommandNotSupported},
+		{UnrecognizedAddrType, AddrTypeNotSupported},
+		{fmt.Errorf("something else"), ServerFailure},
+	} {
+		if code := ReplyCode(tc.err); code != tc.expected {
+			t.Errorf("%v: bad code %v, expected %v", tc.err, code, tc.expected)
+		}
+	}
+}
@@ -0,0 +1,334 @@
+package socks5
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"github.com/google/uuid"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// hopHeaders are removed when forwarding plain HTTP requests
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// ListenAndServeHTTP is used to create a listener and serve HTTP proxy requests on it.
+// The HTTP proxy shares authentication, rules, rewrites, resolver and dialer with the SOCKS5 server.
+func (s *Server) ListenAndServeHTTP(network, addr string) error {
+	l := net.ListenConfig{KeepAlive: time.Second * 1}
+	ll, err := l.Listen(s.ctx, network, addr)
+	if err != nil {
+		return err
+	} else {
+		s.Lg.Lg.Info().Msgf("start new http proxy %v listener on %v", network, addr)
+	}
+	return s.ServeHTTPListener(ll)
+}
+
+// ServeHTTPListener is used to serve HTTP proxy requests from a listener
+func (s *Server) ServeHTTPListener(l net.Listener) error {
+	srv := &http.Server{
+		Handler:           &httpProxy{s: s, listener: l.Addr().String()},
+		ReadHeaderTimeout: connDeadline,
+		// Request contexts end on server shutdown or when the client disconnects
+		BaseContext: func(net.Listener) context.Context {
+			return s.ctx
+		},
+	}
+	go func() {
+		<-s.ctx.Done()
+		_ = srv.Close()
+		s.Lg.Lg.Trace().Msgf("close http listener")
+	}()
+	err := srv.Serve(l)
+	select {
+	case <-s.ctx.Done():
+		s.Lg.Lg.Info().Msgf("close http listener")
+		return nil
+	default:
+		return fmt.Errorf("failed to serve http proxy: %v", err)
+	}
+}
+
+// httpProxy handles CONNECT tunnels and absolute-URI requests
+type httpProxy struct {
+	s        *Server
+	listener string
+}
+
+func (p *httpProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s := p.s
+	s.metrics().ConnOpened(p.listener)
+	defer s.metrics().ConnClosed(p.listener)
+	connId := uuid.New()
+	l := *s.Lg
+	l.AddField(map[string]string{"connId": connId.String()})
+
+	if r.Method != http.MethodConnect && !r.URL.IsAbs() {
+		http.Error(w, "not a proxy request", http.StatusBadRequest)
+		return
+	}
+	// Plain requests are forwarded as is, https goes through CONNECT tunnels
+	if r.Method != http.MethodConnect && r.URL.Scheme != "http" {
+		http.Error(w, "unsupported scheme "+r.URL.Scheme, http.StatusBadRequest)
+		return
+	}
+
+	// Authenticate the request
+	info := &ConnInfo{ID: connId, Listener: p.listener, TLS: r.TLS}
+	if client, err := net.ResolveTCPAddr("tcp", r.RemoteAddr); err == nil {
+		info.RemoteAddr = client
+	}
+	if local, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		info.LocalAddr = local
+	}
+
+	// Count the request, clients over quota are rejected before authentication
+	releaseConn, err := s.admission.admitConn(info.RemoteAddr)
+	defer releaseConn()
+	if err != nil {
+		l.Lg.Warn().Msgf("rejected connection: %v", err)
+		s.metrics().Reply(ReplyCode(err))
+		http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		return
+	}
+	authContext, user, ok := s.httpAuthenticate(r.Context(), info, r)
+	if !ok {
+		l.Lg.Warn().Msgf("failed to authenticate: user %v authentication failed", user)
+		w.Header().Set("Proxy-Authenticate", `Basic realm="gosocks5"`)
+		http.Error(w, "proxy authentication required", http.StatusProxyAuthRequired)
+		return
+	}
+	reqId := uuid.New()
+	l.AddField(map[string]string{"reqId": reqId.String(), "user": user})
+	releaseUser, err := s.admission.admitUser(user)
+	defer releaseUser()
+	if err != nil {
+		l.Lg.Warn().Msgf("rejected request: %v", err)
+		s.metrics().Reply(ReplyCode(err))
+		http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		return
+	}
+
+	// Synthesize a SOCKS5 connect request
+	hostPort := r.Host
+	if r.Method != http.MethodConnect {
+		hostPort = r.URL.Host
+		if r.URL.Port() == "" {
+			hostPort = net.JoinHostPort(r.URL.Hostname(), "80")
+		}
+	}
+	dest, err := httpAddrSpec(hostPort)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req := &Request{
+		Id:          reqId,
+		Lg:          &l,
+		Version:     socks5Version,
+		Command:     ConnectCommand,
+		AuthContext: authContext,
+		DestAddr:    dest,
+	}
+	if client, err := httpAddrSpec(r.RemoteAddr); err == nil {
+		req.RemoteAddr = client
+	}
+	l.Lg.Debug().Msgf("%s -> %s (http %v)", req.RemoteAddr, req.DestAddr, r.Method)
+
+	target, status, err := s.httpDial(r.Context(), req)
+	s.metrics().Reply(req.Reply)
+	if err != nil {
+		l.Lg.Warn().Msgf("failed to handle request: %v", err)
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	defer func() {
+		err = target.Close()
+		if err != nil {
+			req.Lg.Lg.Warn().Msgf("failed to close target %v: %v", req.realDestAddr.Address(), err)
+		} else {
+			req.Lg.Lg.Trace().Msgf("close target %v", req.realDestAddr.Address())
+		}
+	}()
+
+	traffic := s.newTrafficCounter(req, stopConn(target))
+	if r.Method == http.MethodConnect {
+		err = s.httpTunnel(w, req, target, traffic)
+	} else {
+		err = httpForward(w, r, target, traffic)
+	}
+	s.recordTraffic(req, req.DestAddr, traffic)
+	if err != nil {
+		l.Lg.Warn().Msgf("failed to handle request: %v", err)
+	}
+}
+
+// httpAuthenticate checks Proxy-Authorization against the configured CredentialStore.
+// Requests without credentials are allowed only with "auth-less" mode.
+// The auth policies of the client network apply.
+func (s *Server) httpAuthenticate(ctx context.Context, info *ConnInfo, r *http.Request) (*AuthContext, string, bool) {
+	user, pass, ok := proxyBasicAuth(r)
+	if !ok {
+		if s.allowsAnonymous(info) {
+			s.metrics().AuthResult(NoAuth, true)
+			return &AuthContext{NoAuth, nil}, "", true
+		}
+		s.metrics().AuthResult(NoAcceptable, false)
+		return nil, "", false
+	}
+	if !s.allowsAuth(info, UserPassAuth) {
+		s.metrics().AuthResult(NoAcceptable, false)
+		return nil, user, false
+	}
+
+	creds := s.credentials()
+	if creds == nil || !validCredentials(ctx, creds, info, user, pass) {
+		s.metrics().AuthResult(UserPassAuth, false)
+		return nil, user, false
+	}
+	s.metrics().AuthResult(UserPassAuth, true)
+	return &AuthContext{UserPassAuth, userPayload(creds, user)}, user, true
+}
+
+// httpDial resolves, checks and dials the destination of the request.
+// Returns the HTTP status to answer with on failure.
+func (s *Server) httpDial(ctx context.Context, req *Request) (net.Conn, int, error) {
+	target, err := s.httpConnect(ctx, req)
+	req.Reply = ReplyCode(err)
+	switch req.Reply {
+	case SuccessReply:
+		return target, http.StatusOK, nil
+	case RuleFailure:
+		return nil, http.StatusForbidden, err
+	case TTLExpired:
+		return nil, http.StatusGatewayTimeout, err
+	default:
+		return nil, http.StatusBadGateway, err
+	}
+}
+
+func (s *Server) httpConnect(ctx context.Context, req *Request) (net.Conn, error) {
+	if err := s.checkDataQuota(req); err != nil {
+		return nil, err
+	}
+	ctx, err := s.prepareRequest(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	target, err := s.dialRequest(ctx, "tcp", req)
+	if err != nil {
+		return nil, fmt.Errorf("connect to %v failed: %w", req.DestAddr, err)
+	}
+	return s.limitConn(ctx, req, target), nil
+}
+
+// httpTunnel answers the CONNECT request and relays the raw connection
+func (s *Server) httpTunnel(w http.ResponseWriter, req *Request, target net.Conn, traffic *trafficCounter) error {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "tunneling is not supported", http.StatusInternalServerError)
+		return fmt.Errorf("http connection does not support hijacking")
+	}
+	conn, bufrw, err := hj.Hijack()
+	if err != nil {
+		return fmt.Errorf("failed to hijack connection: %v", err)
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	_ = conn.SetDeadline(time.Time{})
+	if _, err := conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+		return fmt.Errorf("failed to send reply: %v", err)
+	}
+
+	// The reader may hold bytes sent right after the request
+	req.bufConn = bufrw.Reader
+	return relay(req, conn, target, traffic)
+}
+
+// httpForward sends an absolute-URI request to the target and copies the response back
+// counting the traffic
+func httpForward(w http.ResponseWriter, r *http.Request, target net.Conn, traffic *trafficCounter) error {
+	out := r.Clone(r.Context())
+	out.RequestURI = ""
+	out.Close = true
+	removeHopHeaders(out.Header)
+	if err := out.Write(countingWriter{target, traffic.addUp}); err != nil {
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return fmt.Errorf("failed to send request: %v", err)
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(countingReader{target, traffic.addDown}), out)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return fmt.Errorf("failed to read response: %v", err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	removeHopHeaders(resp.Header)
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(resp.StatusCode)
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+func removeHopHeaders(h http.Header) {
+	for _, f := range h["Connection"] {
+		for _, k := range strings.Split(f, ",") {
+			h.Del(strings.TrimSpace(k))
+		}
+	}
+	for _, k := range hopHeaders {
+		h.Del(k)
+	}
+}
+
+// proxyBasicAuth returns the username and password from the Proxy-Authorization header
+func proxyBasicAuth(r *http.Request) (string, string, bool) {
+	auth := r.Header.Get("Proxy-Authorization")
+	const prefix = "Basic "
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return "", "", false
+	}
+	c, err := base64.StdEncoding.DecodeString(auth[len(prefix):])
+	if err != nil {
+		return "", "", false
+	}
+	user, pass, ok := strings.Cut(string(c), ":")
+	return user, pass, ok
+}
+
+// httpAddrSpec is used to convert host:port into AddrSpec
+func httpAddrSpec(hostPort string) (*AddrSpec, error) {
+	host, portStr, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address %v: %v", hostPort, err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 0 || port > 0xffff {
+		return nil, fmt.Errorf("invalid port %v", portStr)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return &AddrSpec{IP: ip, Port: port}, nil
+	}
+	return &AddrSpec{FQDN: host, Port: port}, nil
+}
@@ -0,0 +1,158 @@
+package socks5
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func newHTTPProxy(t *testing.T, conf *Config) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	serv, err := New(ctx, testLogger(t), conf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	go func() {
+		_ = serv.ServeHTTPListener(l)
+	}()
+	return l.Addr().String()
+}
+
+func httpProxyClient(proxyAddr string, user *url.Userinfo, tlsServer *httptest.Server) *http.Client {
+	transport := &http.Transport{Proxy: http.ProxyURL(&url.URL{Scheme: "http", Host: proxyAddr, User: user})}
+	if tlsServer != nil {
+		transport.TLSClientConfig = tlsServer.Client().Transport.(*http.Transport).TLSClientConfig
+	}
+	return &http.Client{Transport: transport}
+}
+
+func TestHTTPProxy(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Proxy-Authorization") != "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		_, _ = w.Write([]byte("pong"))
+	})
+	web := httptest.NewServer(handler)
+	defer web.Close()
+	tlsWeb := httptest.NewTLSServer(handler)
+	defer tlsWeb.Close()
+
+	proxyAddr := newHTTPProxy(t, &Config{Credentials: testCredentials{"foo": "bar"}})
+
+	for _, tc := range []struct {
+		name   string
+		url    string
+		tls    *httptest.Server
+		user   *url.Userinfo
+		status int
+	}{
+		{"forward", web.URL, nil, url.UserPassword("foo", "bar"), http.StatusOK},
+		{"connect", tlsWeb.URL, tlsWeb, url.UserPassword("foo", "bar"), http.StatusOK},
+		{"no credentials", web.URL, nil, nil, http.StatusProxyAuthRequired},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, err := httpProxyClient(proxyAddr, tc.user, tc.tls).Get(tc.url)
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != tc.status {
+				t.Fatalf("bad: %v", resp.Status)
+			}
+			if tc.status != http.StatusOK {
+				return
+			}
+			body, _ := io.ReadAll(resp.Body)
+			if string(body) != "pong" {
+				t.Fatalf("bad: %s", body)
+			}
+		})
+	}
+}
+
+func TestHTTPProxy_RuleFail(t *testing.T) {
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer web.Close()
+
+	proxyAddr := newHTTPProxy(t, &Config{Rules: PermitNone()})
+	resp, err := httpProxyClient(proxyAddr, nil, nil).Get(web.URL)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("bad: %v", resp.Status)
+	}
+}
+
+func TestHTTPProxy_UnsupportedScheme(t *testing.T) {
+	proxyAddr := newHTTPProxy(t, &Config{})
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+
+	// An https absolute-URI would be sent in plain text, clients use CONNECT for it
+	conn.Write([]byte("GET https://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("bad: %v", resp.Status)
+	}
+}
+
+func TestHTTPProxy_Admission(t *testing.T) {
+	m := newTestMetrics()
+	s, err := New(context.Background(), testLogger(t), &Config{
+		Credentials: testCredentials{"foo": "bar"},
+		ConnQuota:   ConnQuota{PerSource: 1, PerUser: 1},
+		Metrics:     m,
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	proxy := &httpProxy{s: s, listener: "test"}
+	serve := func() int {
+		r := httptest.NewRequest(http.MethodGet, "http://192.0.2.1/", nil)
+		r.RemoteAddr = "192.0.2.10:50000"
+		r.SetBasicAuth("foo", "bar")
+		r.Header.Set("Proxy-Authorization", r.Header.Get("Authorization"))
+		rec := httptest.NewRecorder()
+		proxy.ServeHTTP(rec, r)
+		return rec.Code
+	}
+
+	// Over the user and the source limit the requests are rejected with a rule failure
+	releaseUser, _ := s.admission.admitUser("foo")
+	if code := serve(); code != http.StatusTooManyRequests {
+		t.Fatalf("user quota: bad: %v", code)
+	}
+	releaseUser()
+	releaseConn, _ := s.admission.admitConn(&net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 1})
+	defer releaseConn()
+	if code := serve(); code != http.StatusTooManyRequests {
+		t.Fatalf("source quota: bad: %v", code)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.replies[RuleFailure] != 2 || len(m.replies) != 1 {
+		t.Fatalf("bad replies: %v", m.replies)
+	}
+}
@@ -0,0 +1,47 @@
+package socks5
+
+import (
+	"time"
+)
+
+// Metrics observes the server, e.g. to export prometheus metrics.
+// All methods are called concurrently.
+type Metrics interface {
+	// ConnOpened and ConnClosed are called for every client connection of the listener,
+	// for the http proxy for every request
+	ConnOpened(listener string)
+	ConnClosed(listener string)
+	// AuthResult is called for every auth attempt with the selected method,
+	// NoAcceptable if the client offered no usable method
+	AuthResult(method uint8, ok bool)
+	// Reply is called with the reply code of every request
+	Reply(code uint8)
+	// Resolved is called after every destination name lookup
+	Resolved(d time.Duration, err error)
+	// Dialed is called after every destination dial including all attempts
+	Dialed(d time.Duration, err error)
+	// Relayed is called with the bytes relayed up to or down from destinations
+	Relayed(up, down int64)
+	// RuleDecision is called for every RuleSet evaluation
+	RuleDecision(phase RulePhase, allowed bool)
+}
+
+// noMetrics discards the observations
+type noMetrics struct{}
+
+func (noMetrics) ConnOpened(string)             {}
+func (noMetrics) ConnClosed(string)             {}
+func (noMetrics) AuthResult(uint8, bool)        {}
+func (noMetrics) Reply(uint8)                   {}
+func (noMetrics) Resolved(time.Duration, error) {}
+func (noMetrics) Dialed(time.Duration, error)   {}
+func (noMetrics) Relayed(int64, int64)          {}
+func (noMetrics) RuleDecision(RulePhase, bool)  {}
+
+// metrics returns Config.Metrics or a no-op implementation
+func (s *Server) metrics() Metrics {
+	if s.config.Metrics == nil {
+		return noMetrics{}
+	}
+	return s.config.Metrics
+}
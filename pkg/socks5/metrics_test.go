@@ -0,0 +1,161 @@
+package socks5
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testMetrics counts the observations
+type testMetrics struct {
+	mu       sync.Mutex
+	active   map[string]int
+	auth     map[uint8][2]int
+	replies  map[uint8]int
+	dials    int
+	up, down int64
+	rules    map[RulePhase]int
+}
+
+func newTestMetrics() *testMetrics {
+	return &testMetrics{
+		active:  make(map[string]int),
+		auth:    make(map[uint8][2]int),
+		replies: make(map[uint8]int),
+		rules:   make(map[RulePhase]int),
+	}
+}
+
+func (m *testMetrics) ConnOpened(listener string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.active[listener]++
+}
+
+func (m *testMetrics) ConnClosed(listener string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.active[listener]--
+}
+
+func (m *testMetrics) AuthResult(method uint8, ok bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	counts := m.auth[method]
+	if ok {
+		counts[0]++
+	} else {
+		counts[1]++
+	}
+	m.auth[method] = counts
+}
+
+func (m *testMetrics) Reply(code uint8) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.replies[code]++
+}
+
+func (m *testMetrics) Resolved(time.Duration, error) {}
+
+func (m *testMetrics) Dialed(_ time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err == nil {
+		m.dials++
+	}
+}
+
+func (m *testMetrics) Relayed(up, down int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.up += up
+	m.down += down
+}
+
+func (m *testMetrics) RuleDecision(phase RulePhase, allowed bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if allowed {
+		m.rules[phase]++
+	}
+}
+
+func TestServeConnection_Metrics(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			t.Errorf("err: %v", err)
+			return
+		}
+		defer conn.Close()
+		io.ReadAtLeast(conn, make([]byte, 4), 4)
+		conn.Write([]byte("pong pong"))
+	}()
+	lAddr := l.Addr().(*net.TCPAddr)
+
+	m := newTestMetrics()
+	s, _ := New(context.Background(), testLogger(t), &Config{
+		Credentials: testCredentials{"foo": "bar"},
+		Metrics:     m,
+	})
+	serve := func(auth []byte) error {
+		client, server := net.Pipe()
+		defer client.Close()
+		served := make(chan error, 1)
+		go func() {
+			served <- s.ServeConnection(Connection{Lg: testLogger(t), conn: server, listener: "test"})
+		}()
+		client.SetDeadline(time.Now().Add(time.Second))
+		client.Write([]byte{socks5Version, 1, UserPassAuth})
+		io.ReadAtLeast(client, make([]byte, 2), 2)
+		client.Write(auth)
+		resp := make([]byte, 2)
+		io.ReadAtLeast(client, resp, 2)
+		if resp[1] == authSuccess {
+			req := []byte{5, 1, 0, 1, 127, 0, 0, 1, 0, 0}
+			binary.BigEndian.PutUint16(req[8:], uint16(lAddr.Port))
+			client.Write(req)
+			if _, err := ReadReply(client); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			client.Write([]byte("ping"))
+			io.ReadAtLeast(client, make([]byte, 9), 9)
+			client.Close()
+		}
+		return <-served
+	}
+
+	if err := serve([]byte{1, 3, 'f', 'o', 'o', 3, 'b', 'a', 'z'}); err == nil {
+		t.Fatalf("authenticated with a bad password")
+	}
+	if err := serve([]byte{1, 3, 'f', 'o', 'o', 3, 'b', 'a', 'r'}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.active["test"] != 0 {
+		t.Fatalf("bad active: %v", m.active)
+	}
+	if m.auth[UserPassAuth] != [2]int{1, 1} {
+		t.Fatalf("bad auth: %v", m.auth)
+	}
+	if m.replies[SuccessReply] != 1 || len(m.replies) != 1 {
+		t.Fatalf("bad replies: %v", m.replies)
+	}
+	if m.dials != 1 || m.rules[PreResolve] != 1 || m.rules[Final] != 1 {
+		t.Fatalf("bad dials %v or rules %v", m.dials, m.rules)
+	}
+	if m.up != 4 || m.down != 9 {
+		t.Fatalf("bad relayed: %v %v", m.up, m.down)
+	}
+}
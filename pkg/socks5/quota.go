@@ -0,0 +1,131 @@
+package socks5
+
+import (
+	"fmt"
+	"net"
+	"sync"
+)
+
+// ConnQuota limits concurrent connections, 0 is unlimited
+type ConnQuota struct {
+	// Total limits the connections of all clients
+	Total int
+	// PerSource limits the connections of each client ip
+	PerSource int
+	// PerUser limits the connections of each authenticated user
+	PerUser int
+}
+
+// DataQuota limits the data relayed for authenticated users,
+// sessions of anonymous clients are not limited
+type DataQuota interface {
+	// CheckQuota returns an error wrapping DataQuotaExceeded if the user has no data left.
+	// It is called before connect and associate requests.
+	CheckQuota(user string) error
+	// AddData counts the bytes relayed for the user in any direction.
+	// Returns false once the user is over the quota.
+	AddData(user string, n int64) bool
+}
+
+// checkDataQuota refuses new connect and associate sessions of users over the quota
+func (s *Server) checkDataQuota(req *Request) error {
+	if s.config.DataQuota == nil || (req.Command != ConnectCommand && req.Command != AssociateCommand) {
+		return nil
+	}
+	user := requestUser(req)
+	if user == "" {
+		return nil
+	}
+	return s.config.DataQuota.CheckQuota(user)
+}
+
+// admission counts the active connections and enforces ConnQuota.
+// Sources and the total are checked on accept, before authentication,
+// users once the request is authenticated.
+type admission struct {
+	quota ConnQuota
+
+	mu      sync.Mutex
+	total   int
+	sources map[string]int
+	users   map[string]int
+}
+
+func newAdmission(quota ConnQuota) *admission {
+	return &admission{
+		quota:   quota,
+		sources: make(map[string]int),
+		users:   make(map[string]int),
+	}
+}
+
+// admitConn counts a new connection of the client.
+// The returned function releases it and is safe to call more than once.
+func (a *admission) admitConn(client net.Addr) (func(), error) {
+	source := sourceKey(client)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.quota.Total > 0 && a.total >= a.quota.Total {
+		return func() {}, fmt.Errorf("%w: %v total connections", ConnQuotaExceeded, a.quota.Total)
+	}
+	if a.quota.PerSource > 0 && a.sources[source] >= a.quota.PerSource {
+		return func() {}, fmt.Errorf("%w: %v connections from source %v", ConnQuotaExceeded, a.quota.PerSource, source)
+	}
+	a.total++
+	a.sources[source]++
+	return a.releaser(func() {
+		a.total--
+		release(a.sources, source)
+	}), nil
+}
+
+// admitUser counts a new connection of the user.
+// The returned function releases it and is safe to call more than once.
+func (a *admission) admitUser(user string) (func(), error) {
+	if user == "" {
+		return func() {}, nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.quota.PerUser > 0 && a.users[user] >= a.quota.PerUser {
+		return func() {}, fmt.Errorf("%w: %v connections of user %v", ConnQuotaExceeded, a.quota.PerUser, user)
+	}
+	a.users[user]++
+	return a.releaser(func() {
+		release(a.users, user)
+	}), nil
+}
+
+// releaser runs the release under the lock exactly once
+func (a *admission) releaser(fn func()) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			a.mu.Lock()
+			defer a.mu.Unlock()
+			fn()
+		})
+	}
+}
+
+// release decrements the counter dropping unused keys
+func release(counts map[string]int, key string) {
+	counts[key]--
+	if counts[key] <= 0 {
+		delete(counts, key)
+	}
+}
+
+// sourceKey returns the client ip, connections from all ports of a host share the quota
+func sourceKey(client net.Addr) string {
+	if client == nil {
+		return ""
+	}
+	if tcp, ok := client.(*net.TCPAddr); ok {
+		return tcp.IP.String()
+	}
+	if host, _, err := net.SplitHostPort(client.String()); err == nil {
+		return host
+	}
+	return client.String()
+}
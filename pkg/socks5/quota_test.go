@@ -0,0 +1,291 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestAdmission(t *testing.T) {
+	a := newAdmission(ConnQuota{Total: 3, PerSource: 2, PerUser: 1})
+	client := func(ip string, port int) net.Addr {
+		return &net.TCPAddr{IP: net.ParseIP(ip), Port: port}
+	}
+
+	release1, err := a.admitConn(client("10.0.0.1", 1000))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := a.admitConn(client("10.0.0.1", 1001)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := a.admitConn(client("10.0.0.1", 1002)); !errors.Is(err, ConnQuotaExceeded) {
+		t.Fatalf("source quota: bad: %v", err)
+	}
+	if _, err := a.admitConn(client("10.0.0.2", 1000)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := a.admitConn(client("10.0.0.3", 1000)); !errors.Is(err, ConnQuotaExceeded) {
+		t.Fatalf("total quota: bad: %v", err)
+	}
+
+	// Releasing twice frees a single slot
+	release1()
+	release1()
+	if a.total != 2 || a.sources["10.0.0.1"] != 1 {
+		t.Fatalf("bad: %v %v", a.total, a.sources)
+	}
+
+	releaseUser, err := a.admitUser("foo")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := a.admitUser("foo"); !errors.Is(err, ConnQuotaExceeded) {
+		t.Fatalf("user quota: bad: %v", err)
+	}
+	if _, err := a.admitUser(""); err != nil {
+		t.Fatalf("anonymous: bad: %v", err)
+	}
+	releaseUser()
+	if len(a.users) != 0 {
+		t.Fatalf("bad: %v", a.users)
+	}
+}
+
+func TestServeConnection_ConnQuota(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dialing := make(chan struct{}, 1)
+	s, _ := New(ctx, testLogger(t), &Config{
+		Credentials: testCredentials{"foo": "bar"},
+		ConnQuota:   ConnQuota{PerSource: 2, PerUser: 1},
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialing <- struct{}{}
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+	})
+	serve := func() (net.Conn, chan error) {
+		client, server := net.Pipe()
+		served := make(chan error, 1)
+		go func() {
+			served <- s.ServeConnection(Connection{Lg: testLogger(t), conn: server})
+		}()
+		client.SetDeadline(time.Now().Add(time.Second))
+		return client, served
+	}
+	connect := func(client net.Conn) error {
+		client.Write([]byte{socks5Version, 1, UserPassAuth})
+		io.ReadAtLeast(client, make([]byte, 2), 2)
+		client.Write([]byte{1, 3, 'f', 'o', 'o', 3, 'b', 'a', 'r'})
+		io.ReadAtLeast(client, make([]byte, 2), 2)
+		client.Write([]byte{5, 1, 0, 1, 192, 0, 2, 1, 0, 80})
+		_, err := ReadReply(client)
+		return err
+	}
+
+	// The first connection of the user waits in dial
+	first, _ := serve()
+	defer first.Close()
+	go connect(first)
+	<-dialing
+
+	// The second one is over the user quota after authentication
+	second, served := serve()
+	defer second.Close()
+	var replyErr *ReplyError
+	if err := connect(second); !errors.As(err, &replyErr) || replyErr.Code != RuleFailure {
+		t.Fatalf("bad: %v", err)
+	}
+	if err := <-served; !errors.Is(err, ConnQuotaExceeded) {
+		t.Fatalf("bad: %v", err)
+	}
+
+	// With the first connection open a third one from the source is allowed,
+	// a fourth one is refused before authentication
+	third, _ := serve()
+	defer third.Close()
+	third.Write([]byte{socks5Version, 1, UserPassAuth})
+	io.ReadAtLeast(third, make([]byte, 2), 2)
+	fourth, served := serve()
+	defer fourth.Close()
+	fourth.Write([]byte{socks5Version, 1, UserPassAuth})
+	out := make([]byte, 2)
+	if _, err := io.ReadAtLeast(fourth, out, len(out)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(out, []byte{socks5Version, NoAcceptable}) {
+		t.Fatalf("bad: %v", out)
+	}
+	if err := <-served; !errors.Is(err, ConnQuotaExceeded) {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
+// testDataQuota allows limit bytes per user
+type testDataQuota struct {
+	limit int64
+	mu    sync.Mutex
+	used  map[string]int64
+}
+
+func (q *testDataQuota) CheckQuota(user string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.used[user] >= q.limit {
+		return fmt.Errorf("%w: %v bytes", DataQuotaExceeded, q.limit)
+	}
+	return nil
+}
+
+func (q *testDataQuota) AddData(user string, n int64) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.used[user] += n
+	return q.used[user] < q.limit
+}
+
+func TestRequest_DataQuota(t *testing.T) {
+	// The target sends until the session is closed
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			if _, err := conn.Write(make([]byte, 1024)); err != nil {
+				return
+			}
+		}
+	}()
+	lAddr := l.Addr().(*net.TCPAddr)
+
+	quota := &testDataQuota{limit: 64 * 1024, used: map[string]int64{"bar": 64 * 1024}}
+	s := &Server{ctx: context.Background(), config: &Config{
+		Rules:          PermitAll(),
+		Resolver:       DNSResolver{},
+		DataQuota:      quota,
+		CloseOverQuota: true,
+	}}
+	request := func(user string) (*Request, *MockConn) {
+		buf := bytes.NewBuffer([]byte{5, 1, 0, 1, 127, 0, 0, 1, 0, 0})
+		binary.BigEndian.PutUint16(buf.Bytes()[8:], uint16(lAddr.Port))
+		req, err := NewRequest(uuid.New(), testLogger(t), buf)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		req.AuthContext = &AuthContext{UserPassAuth, map[string]string{"Username": user}}
+		return req, &MockConn{}
+	}
+
+	// A user over the quota is refused
+	req, resp := request("bar")
+	if err := s.handleRequest(context.Background(), req, resp); !errors.Is(err, DataQuotaExceeded) {
+		t.Fatalf("bad: %v", err)
+	}
+	if out := resp.buf.Bytes(); len(out) < 2 || out[1] != RuleFailure {
+		t.Fatalf("bad: %v", out)
+	}
+
+	// The active session is closed once the user reaches the quota
+	req, resp = request("foo")
+	done := make(chan error, 1)
+	go func() {
+		done <- s.handleRequest(context.Background(), req, resp)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("session is not closed")
+	}
+	if used := quota.used["foo"]; used < quota.limit {
+		t.Fatalf("bad: %v", used)
+	}
+}
+
+func TestAssociate_DataQuota(t *testing.T) {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, src, err := echo.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			_, _ = echo.WriteToUDP(buf[:n], src)
+		}
+	}()
+	echoAddr := echo.LocalAddr().(*net.UDPAddr)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	serv, err := New(ctx, testLogger(t), &Config{
+		Credentials:    testCredentials{"foo": "bar"},
+		DataQuota:      &testDataQuota{limit: 1024, used: map[string]int64{}},
+		CloseOverQuota: true,
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	go func() {
+		_ = serv.ServeListener(l)
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte{5, 1, UserPassAuth})
+	conn.Write([]byte{1, 3, 'f', 'o', 'o', 3, 'b', 'a', 'r'})
+	conn.Write([]byte{5, 3, 0, 1, 0, 0, 0, 0, 0, 0})
+	out := make([]byte, 14)
+	if _, err := io.ReadAtLeast(conn, out, len(out)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out[5] != SuccessReply {
+		t.Fatalf("bad: %v", out)
+	}
+	relayAddr := &net.UDPAddr{IP: net.IP(out[8:12]), Port: int(binary.BigEndian.Uint16(out[12:]))}
+
+	client, err := net.DialUDP("udp", nil, relayAddr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer client.Close()
+	pkt := []byte{0, 0, 0, ipv4Address, 127, 0, 0, 1, 0, 0}
+	binary.BigEndian.PutUint16(pkt[8:], uint16(echoAddr.Port))
+	pkt = append(pkt, make([]byte, 512)...)
+	for i := 0; i < 2; i++ {
+		client.Write(pkt)
+	}
+
+	// Reaching the quota ends the control connection with the relay
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("bad: %v", err)
+	}
+}
@@ -0,0 +1,324 @@
+package socks5
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// maxRateChunk limits the bytes taken from a bucket at once,
+// so concurrent connections sharing the bucket interleave
+const maxRateChunk = 16 * 1024
+
+// Bandwidth is a token bucket limit
+type Bandwidth struct {
+	// Rate in bytes per second, 0 is unlimited
+	Rate int
+	// Burst in bytes. Defaults to Rate.
+	Burst int
+}
+
+// RateLimit limits the relayed traffic in both directions.
+// Streams are delayed, udp datagrams over the limit are dropped.
+type RateLimit struct {
+	// Upload limits data sent by the client to the destination
+	Upload Bandwidth
+	// Download limits data sent by the destination to the client
+	Download Bandwidth
+}
+
+// RateLimitStore can be implemented by a CredentialStore
+// to override Config.UserRateLimit per user
+type RateLimitStore interface {
+	RateLimit(user string) (RateLimit, bool)
+}
+
+// newBucket creates a token bucket, unlimited buckets allow everything
+func newBucket(b Bandwidth) *rate.Limiter {
+	if b.Rate <= 0 {
+		return rate.NewLimiter(rate.Inf, 0)
+	}
+	burst := b.Burst
+	if burst <= 0 {
+		burst = b.Rate
+	}
+	return rate.NewLimiter(rate.Limit(b.Rate), burst)
+}
+
+// setBucket updates the limit keeping the bucket shared
+func setBucket(l *rate.Limiter, b Bandwidth) {
+	n := newBucket(b)
+	l.SetBurst(n.Burst())
+	l.SetLimit(n.Limit())
+}
+
+// buckets are the upload and download token buckets of a scope
+type buckets struct {
+	upload   *rate.Limiter
+	download *rate.Limiter
+}
+
+func newBuckets(limit RateLimit) buckets {
+	return buckets{upload: newBucket(limit.Upload), download: newBucket(limit.Download)}
+}
+
+// userBuckets are shared by the connections of a user
+type userBuckets struct {
+	buckets
+	refs int
+}
+
+// rateLimiter keeps the global buckets and the buckets of the users with open connections
+type rateLimiter struct {
+	global buckets
+
+	mu    sync.Mutex
+	users map[string]*userBuckets
+}
+
+func newRateLimiter(global RateLimit) *rateLimiter {
+	return &rateLimiter{
+		global: newBuckets(global),
+		users:  make(map[string]*userBuckets),
+	}
+}
+
+// acquire returns the buckets of the user with the current limit applied.
+// The returned function releases them when the connection closes.
+func (r *rateLimiter) acquire(user string, limit RateLimit) (buckets, func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	u, found := r.users[user]
+	if found {
+		setBucket(u.upload, limit.Upload)
+		setBucket(u.download, limit.Download)
+	} else {
+		u = &userBuckets{buckets: newBuckets(limit)}
+		r.users[user] = u
+	}
+	u.refs++
+	return u.buckets, func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		u.refs--
+		if u.refs == 0 {
+			delete(r.users, user)
+		}
+	}
+}
+
+// requestBuckets returns the global and user buckets of the request.
+// The returned function releases the user buckets.
+func (s *Server) requestBuckets(req *Request) (upload, download []*rate.Limiter, release func()) {
+	upload = []*rate.Limiter{s.limits.global.upload}
+	download = []*rate.Limiter{s.limits.global.download}
+	release = func() {}
+	if user := requestUser(req); user != "" {
+		var u buckets
+		u, release = s.limits.acquire(user, s.userRateLimit(req, user))
+		upload = append(upload, u.upload)
+		download = append(download, u.download)
+	}
+	return upload, download, release
+}
+
+// limitConn limits the relayed traffic of the connection to the destination.
+// Writes are uploads and reads are downloads.
+func (s *Server) limitConn(ctx context.Context, req *Request, target net.Conn) net.Conn {
+	if s.limits == nil {
+		return target
+	}
+	c := &limitedConn{Conn: target, ctx: ctx}
+	c.upload, c.download, c.release = s.requestBuckets(req)
+	if !limited(c.upload) && !limited(c.download) {
+		// Keep the fast path of the plain connection
+		c.release()
+		return target
+	}
+	return c
+}
+
+// packetLimiter polices the datagrams of a udp association with the buckets
+// of the request. Datagrams can not be split or delayed without stalling
+// the relay, so datagrams over the limit are dropped.
+type packetLimiter struct {
+	upload   []*rate.Limiter
+	download []*rate.Limiter
+
+	once    sync.Once
+	release func()
+}
+
+// limitPackets returns the limiter of the udp association,
+// nil if the request is not limited
+func (s *Server) limitPackets(req *Request) *packetLimiter {
+	if s.limits == nil {
+		return nil
+	}
+	p := &packetLimiter{}
+	p.upload, p.download, p.release = s.requestBuckets(req)
+	if !limited(p.upload) && !limited(p.download) {
+		p.release()
+		return nil
+	}
+	return p
+}
+
+// allowUp reports whether a datagram of n bytes to the destination is within the limit
+func (p *packetLimiter) allowUp(n int) bool {
+	return p == nil || allowBuckets(p.upload, n)
+}
+
+// allowDown reports whether a datagram of n bytes to the client is within the limit
+func (p *packetLimiter) allowDown(n int) bool {
+	return p == nil || allowBuckets(p.download, n)
+}
+
+// close releases the user buckets
+func (p *packetLimiter) close() {
+	if p != nil {
+		p.once.Do(p.release)
+	}
+}
+
+func limited(limiters []*rate.Limiter) bool {
+	for _, l := range limiters {
+		if l.Limit() != rate.Inf {
+			return true
+		}
+	}
+	return false
+}
+
+// requestUser returns the authenticated username
+func requestUser(req *Request) string {
+	if req.AuthContext == nil {
+		return ""
+	}
+	return req.AuthContext.Payload["Username"]
+}
+
+// userRateLimit returns the limit of the user from the credential store
+// or the configured one
+func (s *Server) userRateLimit(req *Request, user string) RateLimit {
+	if req.AuthContext.Method == UserPassAuth {
+		if store, ok := s.credentials().(RateLimitStore); ok {
+			if limit, found := store.RateLimit(user); found {
+				return limit
+			}
+		}
+	}
+	return s.config.UserRateLimit
+}
+
+// limitedConn waits for the buckets before data is passed
+type limitedConn struct {
+	net.Conn
+	ctx      context.Context
+	upload   []*rate.Limiter
+	download []*rate.Limiter
+
+	once    sync.Once
+	release func()
+}
+
+func (c *limitedConn) Read(b []byte) (int, error) {
+	if chunk := bucketChunk(c.download); len(b) > chunk {
+		b = b[:chunk]
+	}
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		if werr := waitBuckets(c.ctx, c.download, n); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return n, err
+}
+
+func (c *limitedConn) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		n := len(b)
+		if chunk := bucketChunk(c.upload); n > chunk {
+			n = chunk
+		}
+		if err := waitBuckets(c.ctx, c.upload, n); err != nil {
+			return written, err
+		}
+		m, err := c.Conn.Write(b[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// CloseWrite keeps half-close of the wrapped connection
+func (c *limitedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+func (c *limitedConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
+
+// bucketChunk returns the most bytes that can be taken from all the buckets at once
+func bucketChunk(limiters []*rate.Limiter) int {
+	chunk := maxRateChunk
+	for _, l := range limiters {
+		if l.Limit() != rate.Inf && l.Burst() < chunk {
+			chunk = l.Burst()
+		}
+	}
+	if chunk < 1 {
+		chunk = 1
+	}
+	return chunk
+}
+
+// allowBuckets takes n bytes from all the buckets if they are available now.
+// Datagrams larger than a burst take the whole burst.
+func allowBuckets(limiters []*rate.Limiter, n int) bool {
+	now := time.Now()
+	var reserved []*rate.Reservation
+	for _, l := range limiters {
+		if l.Limit() == rate.Inf {
+			continue
+		}
+		take := n
+		if burst := l.Burst(); take > burst {
+			take = burst
+		}
+		r := l.ReserveN(now, take)
+		if !r.OK() || r.DelayFrom(now) > 0 {
+			r.CancelAt(now)
+			for _, r := range reserved {
+				r.CancelAt(now)
+			}
+			return false
+		}
+		reserved = append(reserved, r)
+	}
+	return true
+}
+
+func waitBuckets(ctx context.Context, limiters []*rate.Limiter, n int) error {
+	for _, l := range limiters {
+		if l.Limit() == rate.Inf {
+			continue
+		}
+		if err := l.WaitN(ctx, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package socks5
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// limitedCredentials gives users their own limits
+type limitedCredentials struct {
+	testCredentials
+	limits map[string]RateLimit
+}
+
+func (c limitedCredentials) RateLimit(user string) (RateLimit, bool) {
+	limit, ok := c.limits[user]
+	return limit, ok
+}
+
+func TestLimitConn_Upload(t *testing.T) {
+	s, _ := New(context.Background(), testLogger(t), &Config{
+		UserRateLimit: RateLimit{Upload: Bandwidth{Rate: 10000, Burst: 1000}},
+	})
+	client, server := net.Pipe()
+	defer server.Close()
+	go io.Copy(io.Discard, server)
+
+	req := &Request{AuthContext: &AuthContext{UserPassAuth, map[string]string{"Username": "foo"}}}
+	conn := s.limitConn(context.Background(), req, client)
+	defer conn.Close()
+
+	// The burst passes at once, the rest takes 0.2s
+	start := time.Now()
+	if _, err := conn.Write(make([]byte, 3000)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond || elapsed > time.Second {
+		t.Fatalf("bad: %v", elapsed)
+	}
+}
+
+func TestLimitConn_Unlimited(t *testing.T) {
+	s, _ := New(context.Background(), testLogger(t), &Config{
+		UserRateLimit: RateLimit{Download: Bandwidth{Rate: 1000}},
+	})
+	client, _ := net.Pipe()
+	defer client.Close()
+
+	// Anonymous requests are not limited by the user limit
+	req := &Request{AuthContext: &AuthContext{NoAuth, nil}}
+	if conn := s.limitConn(context.Background(), req, client); conn != client {
+		t.Fatalf("bad: %T", conn)
+	}
+}
+
+func TestLimitConn_SharedByUser(t *testing.T) {
+	creds := limitedCredentials{
+		testCredentials: testCredentials{"foo": "bar", "baz": "qux"},
+		limits:          map[string]RateLimit{"baz": {Download: Bandwidth{Rate: 5000}}},
+	}
+	s, _ := New(context.Background(), testLogger(t), &Config{
+		Credentials:   creds,
+		UserRateLimit: RateLimit{Download: Bandwidth{Rate: 1000}},
+	})
+	user := func(name string) *Request {
+		return &Request{AuthContext: &AuthContext{UserPassAuth, map[string]string{"Username": name}}}
+	}
+
+	var conns []*limitedConn
+	for _, name := range []string{"foo", "foo", "baz"} {
+		client, _ := net.Pipe()
+		conns = append(conns, s.limitConn(context.Background(), user(name), client).(*limitedConn))
+	}
+	if conns[0].download[1] != conns[1].download[1] {
+		t.Fatalf("user bucket is not shared")
+	}
+	if limit := conns[1].download[1].Limit(); limit != 1000 {
+		t.Fatalf("bad: %v", limit)
+	}
+	if limit := conns[2].download[1].Limit(); limit != 5000 {
+		t.Fatalf("bad override: %v", limit)
+	}
+
+	for _, c := range conns {
+		c.Close()
+		c.Close()
+	}
+	if len(s.limits.users) != 0 {
+		t.Fatalf("bad: %v", s.limits.users)
+	}
+}
+
+func TestLimitPackets(t *testing.T) {
+	s, _ := New(context.Background(), testLogger(t), &Config{
+		GlobalRateLimit: RateLimit{Upload: Bandwidth{Rate: 1000}},
+		UserRateLimit:   RateLimit{Upload: Bandwidth{Rate: 100, Burst: 500}},
+	})
+	if p := s.limitPackets(&Request{AuthContext: &AuthContext{NoAuth, nil}}); !p.allowDown(udpBufSize) {
+		t.Fatalf("download is not limited")
+	}
+
+	// Datagrams over the user limit are dropped without taking the global tokens
+	user := &Request{AuthContext: &AuthContext{UserPassAuth, map[string]string{"Username": "foo"}}}
+	p := s.limitPackets(user)
+	defer p.close()
+	if !p.allowUp(400) || p.allowUp(400) {
+		t.Fatalf("user limit is not enforced")
+	}
+	anonymous := s.limitPackets(&Request{AuthContext: &AuthContext{NoAuth, nil}})
+	if !anonymous.allowUp(600) || anonymous.allowUp(600) {
+		t.Fatalf("global limit is not enforced")
+	}
+}
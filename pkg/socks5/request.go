@@ -1,14 +1,14 @@
 package socks5
 
 import (
+	"context"
 	"fmt"
 	"github.com/dossif/gosocks5/pkg/logger"
 	"github.com/google/uuid"
-	"golang.org/x/net/context"
 	"io"
 	"net"
 	"strconv"
-	"strings"
+	"time"
 )
 
 const (
@@ -20,21 +20,31 @@ const (
 	ipv6Address      = uint8(4)
 )
 
+// Reply codes as in RFC 1928
 const (
-	successReply uint8 = iota
-	//serverFailure
-	ruleFailure
-	networkUnreachable
-	hostUnreachable
-	connectionRefused
-	//ttlExpired
-	commandNotSupported
-	addrTypeNotSupported
+	SuccessReply uint8 = iota
+	ServerFailure
+	RuleFailure
+	NetworkUnreachable
+	HostUnreachable
+	ConnectionRefused
+	TTLExpired
+	CommandNotSupported
+	AddrTypeNotSupported
 )
 
-var (
-	unrecognizedAddrType = fmt.Errorf("unrecognized address type")
-)
+// commandName is used in errors and logs
+func commandName(cmd uint8) string {
+	switch cmd {
+	case ConnectCommand:
+		return "connect"
+	case BindCommand:
+		return "bind"
+	case AssociateCommand:
+		return "associate"
+	}
+	return "request"
+}
 
 // AddressRewriter is used to rewrite a destination transparently
 type AddressRewriter interface {
@@ -50,6 +60,9 @@ type AddrSpec struct {
 }
 
 func (a *AddrSpec) String() string {
+	if a.FQDN != "" && len(a.IP) == 0 {
+		return fmt.Sprintf("%s:%d", a.FQDN, a.Port)
+	}
 	if a.FQDN != "" {
 		return fmt.Sprintf("%s (%s):%d", a.FQDN, a.IP, a.Port)
 	}
@@ -81,12 +94,24 @@ type Request struct {
 	DestAddr *AddrSpec
 	// AddrSpec of the actual destination (might be affected by rewrite)
 	realDestAddr *AddrSpec
-	bufConn      io.Reader
+	// Rule phase being evaluated
+	Phase RulePhase
+	// Datagram is set for the checks of udp datagram destinations of an association.
+	// The associate request itself carries the client address as DestAddr.
+	Datagram bool
+	// Reply code sent to the client
+	Reply uint8
+	// Resolved addresses of the destination FQDN in dial order
+	destIPs []net.IP
+	bufConn io.Reader
+	// unwatch stops watching the client for disconnects, see watchClient
+	unwatch func()
 }
 
 type conn interface {
 	Write([]byte) (int, error)
 	RemoteAddr() net.Addr
+	LocalAddr() net.Addr
 }
 
 // NewRequest creates a new Request from the tcp connection
@@ -103,7 +128,7 @@ func NewRequest(id uuid.UUID, lg *logger.Logger, bufConn io.Reader) (*Request, e
 	}
 
 	// Read in the destination address
-	dest, err := readAddrSpec(bufConn)
+	dest, err := ReadAddrSpec(bufConn)
 	if err != nil {
 		return nil, err
 	}
@@ -120,74 +145,157 @@ func NewRequest(id uuid.UUID, lg *logger.Logger, bufConn io.Reader) (*Request, e
 	return request, nil
 }
 
-// handleRequest is used for request processing after authentication
-func (s *Server) handleRequest(req *Request, conn conn) error {
-	// Resolve the address if we have a FQDN
-	dest := req.DestAddr
-	if dest.FQDN != "" {
-		_, addr, err := s.config.Resolver.Resolve(s.ctx, dest.FQDN)
-		if err != nil {
-			if err := sendReply(conn, hostUnreachable, nil); err != nil {
-				return fmt.Errorf("failed to send reply: %v", err)
-			}
-			return fmt.Errorf("failed to resolve destination '%v': %v", dest.FQDN, err)
+// RealDestAddr returns the actual destination after rewrites,
+// it is set before the Final rule phase
+func (r *Request) RealDestAddr() *AddrSpec {
+	return r.realDestAddr
+}
+
+// stopWatch is called before the relay reads from the client
+func (r *Request) stopWatch() {
+	if r.unwatch != nil {
+		r.unwatch()
+		r.unwatch = nil
+	}
+}
+
+// handleRequest is used for request processing after authentication.
+// The ctx is passed through resolve, rules, rewrite and dial.
+func (s *Server) handleRequest(ctx context.Context, req *Request, conn conn) error {
+	// SOCKS4 knows nothing about udp
+	if req.Version == socks4Version && req.Command == AssociateCommand {
+		if err := req.reply(conn, CommandNotSupported, nil); err != nil {
+			return fmt.Errorf("failed to send reply: %v", err)
 		}
-		dest.IP = addr
+		return fmt.Errorf("%w: socks4 %v", UnsupportedCommand, req.Command)
+	}
+	if req.Command != ConnectCommand && req.Command != BindCommand && req.Command != AssociateCommand {
+		if err := req.reply(conn, CommandNotSupported, nil); err != nil {
+			return fmt.Errorf("failed to send reply: %v", err)
+		}
+		return fmt.Errorf("%w: %v", UnsupportedCommand, req.Command)
 	}
 
-	// Apply any address rewrites
-	req.realDestAddr = req.DestAddr
-	if s.config.Rewriter != nil {
-		_, req.realDestAddr = s.config.Rewriter.Rewrite(s.ctx, req)
+	// Users over the data quota can not start new sessions
+	if err := s.checkDataQuota(req); err != nil {
+		if err := req.reply(conn, ReplyCode(err), nil); err != nil {
+			return fmt.Errorf("failed to send reply: %v", err)
+		}
+		return err
+	}
+
+	// Check rules, resolve the destination and apply rewrites
+	ctx, err := s.prepareRequest(ctx, req)
+	if err != nil {
+		if err := req.reply(conn, ReplyCode(err), nil); err != nil {
+			return fmt.Errorf("failed to send reply: %v", err)
+		}
+		return err
 	}
 
 	// Switch on the command
 	switch req.Command {
-	case ConnectCommand:
-		return s.handleConnect(s.ctx, conn, req)
-	case BindCommand: // unsupported now
-		return s.handleBind(s.ctx, conn, req)
-	case AssociateCommand: // unsupported now
-		return s.handleAssociate(s.ctx, conn, req)
+	case BindCommand:
+		return s.handleBind(ctx, conn, req)
+	case AssociateCommand:
+		return s.handleAssociate(ctx, conn, req)
 	default:
-		if err := sendReply(conn, commandNotSupported, nil); err != nil {
-			return fmt.Errorf("failed to send reply: %v", err)
-		}
-		return fmt.Errorf("unsupported command: %v", req.Command)
+		return s.handleConnect(ctx, conn, req)
 	}
 }
 
-// handleConnect is used to handle a connect command
-func (s *Server) handleConnect(ctx context.Context, conn conn, req *Request) error {
-	// Check if this is allowed
-	if _, ok := s.config.Rules.Allow(context.Background(), req); !ok {
-		if err := sendReply(conn, ruleFailure, nil); err != nil {
-			return fmt.Errorf("failed to send reply: %v", err)
+// prepareRequest runs the request pipeline: rules on the requested destination,
+// resolve, rules on each resolved address, rewrite and rules on the actual destination
+func (s *Server) prepareRequest(ctx context.Context, req *Request) (context.Context, error) {
+	ctx, err := s.checkRules(ctx, req, PreResolve)
+	if err != nil {
+		return ctx, err
+	}
+
+	ctx, err = s.resolveRequest(ctx, req)
+	if err != nil {
+		return ctx, err
+	}
+	if len(req.destIPs) > 0 {
+		for _, ip := range req.destIPs {
+			req.DestAddr.IP = ip
+			if ctx, err = s.checkRules(ctx, req, PostResolve); err != nil {
+				return ctx, err
+			}
 		}
-		return fmt.Errorf("connect to %v blocked by rules", req.DestAddr)
+		req.DestAddr.IP = req.destIPs[0]
 	}
 
-	// Attempt to connect
-	dial := s.config.Dial
-	if dial == nil {
-		dial = func(ctx context.Context, net_, addr string) (net.Conn, error) {
-			return net.Dial(net_, addr)
+	// Apply any address rewrites
+	req.realDestAddr = req.DestAddr
+	if s.config.Rewriter != nil {
+		ctx, req.realDestAddr = s.config.Rewriter.Rewrite(ctx, req)
+	}
+	return s.checkRules(ctx, req, Final)
+}
+
+// checkRules evaluates the RuleSet in the phase
+func (s *Server) checkRules(ctx context.Context, req *Request, phase RulePhase) (context.Context, error) {
+	req.Phase = phase
+	ctx, ok := s.config.Rules.Allow(ctx, req)
+	s.metrics().RuleDecision(phase, ok)
+	if !ok {
+		dest := req.DestAddr
+		if phase == Final {
+			dest = req.realDestAddr
 		}
+		return ctx, fmt.Errorf("%v to %v %w (%v)", commandName(req.Command), dest, BlockedByRules, phase)
 	}
-	target, err := dial(ctx, "tcp", req.realDestAddr.Address())
+	return ctx, nil
+}
+
+// resolveRequest is used to resolve the destination FQDN
+func (s *Server) resolveRequest(ctx context.Context, req *Request) (context.Context, error) {
+	// Resolve the address if we have a FQDN and it is not left to the dialer
+	dest := req.DestAddr
+	if dest.FQDN == "" || s.remoteResolve(ctx, req) {
+		return ctx, nil
+	}
+	start := time.Now()
+	ctx, addrs, err := s.config.Resolver.Resolve(ctx, dest.FQDN)
+	s.metrics().Resolved(time.Since(start), err)
 	if err != nil {
-		msg := err.Error()
-		resp := hostUnreachable
-		if strings.Contains(msg, "refused") {
-			resp = connectionRefused
-		} else if strings.Contains(msg, "network is unreachable") {
-			resp = networkUnreachable
-		}
-		if err := sendReply(conn, resp, nil); err != nil {
+		return ctx, &ResolveError{Name: dest.FQDN, Err: err}
+	}
+	req.destIPs = sortAddrs(addrs, s.config.FamilyPreference)
+	if len(req.destIPs) == 0 {
+		return ctx, &ResolveError{Name: dest.FQDN, Err: fmt.Errorf("no %v addresses", s.config.FamilyPreference)}
+	}
+	dest.IP = req.destIPs[0]
+	return ctx, nil
+}
+
+// remoteResolve reports whether the destination FQDN is passed to Config.Dial as is.
+// Only connect requests are dialed, bind and associate always resolve locally.
+func (s *Server) remoteResolve(ctx context.Context, req *Request) bool {
+	if req.Command != ConnectCommand {
+		return false
+	}
+	if s.config.RemoteResolve {
+		return true
+	}
+	if p, ok := s.config.Rules.(ResolvePolicy); ok {
+		return p.RemoteResolve(ctx, req)
+	}
+	return false
+}
+
+// handleConnect is used to handle a connect command
+func (s *Server) handleConnect(ctx context.Context, conn conn, req *Request) error {
+	// Attempt to connect
+	target, err := s.dialRequest(ctx, "tcp", req)
+	if err != nil {
+		if err := req.reply(conn, ReplyCode(err), nil); err != nil {
 			return fmt.Errorf("failed to send reply: %v", err)
 		}
-		return fmt.Errorf("connect to %v failed: %v", req.DestAddr, err)
+		return fmt.Errorf("connect to %v failed: %w", req.DestAddr, err)
 	}
+	target = s.limitConn(ctx, req, target)
 	defer func() {
 		err = target.Close()
 		if err != nil {
@@ -198,69 +306,147 @@ func (s *Server) handleConnect(ctx context.Context, conn conn, req *Request) err
 	}()
 
 	// Send success
-	local := target.LocalAddr().(*net.TCPAddr)
-	bind := AddrSpec{IP: local.IP, Port: local.Port}
-	if err := sendReply(conn, successReply, &bind); err != nil {
+	var bind *AddrSpec
+	if local, ok := target.LocalAddr().(*net.TCPAddr); ok {
+		bind = &AddrSpec{IP: local.IP, Port: local.Port}
+	}
+	if err := req.reply(conn, SuccessReply, bind); err != nil {
 		return fmt.Errorf("failed to send reply: %v", err)
 	}
 
 	// Start proxying
-	errCh := make(chan error, 2)
-	go proxy(req.Lg, target, req.bufConn, errCh)
-	go proxy(req.Lg, conn, target, errCh)
+	req.stopWatch()
+	traffic := s.newTrafficCounter(req, stopConn(target))
+	defer s.recordTraffic(req, req.DestAddr, traffic)
+	return relay(req, conn, target, traffic)
+}
 
-	// Wait
-	for i := 0; i < 2; i++ {
-		e := <-errCh
-		if e != nil {
-			// return from this function closes target (and conn).
-			return e
+// handleBind is used to handle a bind command
+func (s *Server) handleBind(ctx context.Context, conn conn, req *Request) error {
+	// Listen for the incoming connection
+	bindIP := s.bindIP(conn)
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: bindIP})
+	if err != nil {
+		if err := req.reply(conn, ServerFailure, nil); err != nil {
+			return fmt.Errorf("failed to send reply: %v", err)
 		}
+		return fmt.Errorf("failed to listen for bind: %v", err)
 	}
-	return nil
-}
+	defer func() {
+		_ = l.Close()
+	}()
 
-// handleBind is used to handle a connect command
-func (s *Server) handleBind(ctx context.Context, conn conn, req *Request) error {
-	// Check if this is allowed
-	if ctx_, ok := s.config.Rules.Allow(ctx, req); !ok {
-		if err := sendReply(conn, ruleFailure, nil); err != nil {
+	// Send the first reply with the listening address
+	local := l.Addr().(*net.TCPAddr)
+	if err := req.reply(conn, SuccessReply, &AddrSpec{IP: bindIP, Port: local.Port}); err != nil {
+		return fmt.Errorf("failed to send reply: %v", err)
+	}
+	req.Lg.Lg.Trace().Msgf("bind listener on %v", local)
+
+	// Wait for the expected peer
+	target, err := s.acceptBind(ctx, l, req)
+	if err != nil {
+		if err := req.reply(conn, ReplyCode(err), nil); err != nil {
 			return fmt.Errorf("failed to send reply: %v", err)
 		}
-		return fmt.Errorf("bind to %v blocked by rules", req.DestAddr)
-	} else {
-		ctx = ctx_
+		return fmt.Errorf("bind to %v failed: %w", req.DestAddr, err)
 	}
+	target = s.limitConn(ctx, req, target)
+	defer func() {
+		err = target.Close()
+		if err != nil {
+			req.Lg.Lg.Warn().Msgf("failed to close target %v: %v", target.RemoteAddr(), err)
+		} else {
+			req.Lg.Lg.Trace().Msgf("close target %v", target.RemoteAddr())
+		}
+	}()
 
-	// TODO: Support bind
-	if err := sendReply(conn, commandNotSupported, nil); err != nil {
+	// Send the second reply with the peer address
+	remote := target.RemoteAddr().(*net.TCPAddr)
+	if err := req.reply(conn, SuccessReply, &AddrSpec{IP: remote.IP, Port: remote.Port}); err != nil {
 		return fmt.Errorf("failed to send reply: %v", err)
 	}
-	return nil
+
+	// Start proxying
+	req.stopWatch()
+	traffic := s.newTrafficCounter(req, stopConn(target))
+	defer s.recordTraffic(req, req.DestAddr, traffic)
+	return relay(req, conn, target, traffic)
+}
+
+// acceptBind waits for a single connection from the peer
+// expected by the bind request. Connections from other hosts are dropped.
+func (s *Server) acceptBind(ctx context.Context, l *net.TCPListener, req *Request) (net.Conn, error) {
+	if err := l.SetDeadline(time.Now().Add(s.config.BindTimeout)); err != nil {
+		return nil, err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = l.Close()
+		case <-done:
+		}
+	}()
+	expected := req.realDestAddr.IP
+	for {
+		target, err := l.AcceptTCP()
+		if err != nil {
+			return nil, err
+		}
+		remote := target.RemoteAddr().(*net.TCPAddr)
+		if len(expected) == 0 || expected.IsUnspecified() || expected.Equal(remote.IP) {
+			return target, nil
+		}
+		req.Lg.Lg.Debug().Msgf("drop bind connection from unexpected peer %v", remote)
+		_ = target.Close()
+	}
 }
 
-// handleAssociate is used to handle a connect command
+// handleAssociate is used to handle an associate command
 func (s *Server) handleAssociate(ctx context.Context, conn conn, req *Request) error {
-	// Check if this is allowed
-	if ctx_, ok := s.config.Rules.Allow(ctx, req); !ok {
-		if err := sendReply(conn, ruleFailure, nil); err != nil {
+	// Allocate the relay socket
+	bindIP := s.bindIP(conn)
+	relayConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: bindIP})
+	if err != nil {
+		if err := req.reply(conn, ServerFailure, nil); err != nil {
 			return fmt.Errorf("failed to send reply: %v", err)
 		}
-		return fmt.Errorf("associate to %v blocked by rules", req.DestAddr)
-	} else {
-		ctx = ctx_
+		return fmt.Errorf("failed to listen for associate: %v", err)
 	}
-
-	// TODO: Support associate
-	if err := sendReply(conn, commandNotSupported, nil); err != nil {
+	local := relayConn.LocalAddr().(*net.UDPAddr)
+	if err := req.reply(conn, SuccessReply, &AddrSpec{IP: bindIP, Port: local.Port}); err != nil {
+		_ = relayConn.Close()
 		return fmt.Errorf("failed to send reply: %v", err)
 	}
+	req.Lg.Lg.Trace().Msgf("udp relay on %v", local)
+
+	assoc := newUDPAssociation(ctx, s, req, conn, relayConn)
+	go assoc.serve()
+	defer assoc.close()
+
+	// The association terminates when the control connection closes
+	req.stopWatch()
+	if _, err := io.Copy(io.Discard, req.bufConn); err != nil {
+		req.Lg.Lg.Trace().Msgf("control connection closed: %v", err)
+	}
 	return nil
 }
 
-// readAddrSpec is used to read AddrSpec.
+// reply is used to send a reply message in the protocol version of the request.
+// The reply code is recorded on the request.
+func (r *Request) reply(w io.Writer, resp uint8, addr *AddrSpec) error {
+	r.Reply = resp
+	if r.Version == socks4Version {
+		return sendSocks4Reply(w, resp, addr)
+	}
+	return sendReply(w, resp, addr)
+}
+
+// ReadAddrSpec is used to read AddrSpec.
 // Expects an address type byte, followed by the address and port
-func readAddrSpec(r io.Reader) (*AddrSpec, error) {
+func ReadAddrSpec(r io.Reader) (*AddrSpec, error) {
 	d := &AddrSpec{}
 
 	// Get the address type
@@ -297,7 +483,7 @@ func readAddrSpec(r io.Reader) (*AddrSpec, error) {
 		d.FQDN = string(fqdn)
 
 	default:
-		return nil, unrecognizedAddrType
+		return nil, UnrecognizedAddrType
 	}
 
 	// Read the port
@@ -312,6 +498,44 @@ func readAddrSpec(r io.Reader) (*AddrSpec, error) {
 
 // sendReply is used to send a reply message
 func sendReply(w io.Writer, resp uint8, addr *AddrSpec) error {
+	// Format the message
+	msg, err := AppendAddrSpec([]byte{socks5Version, resp, 0}, addr)
+	if err != nil {
+		return err
+	}
+
+	// Send the message
+	_, err = w.Write(msg)
+	return err
+}
+
+// ReadReply is used to read a reply message sent by a SOCKS5 server.
+// Returns a ReplyError along with the address if the reply is a failure
+func ReadReply(r io.Reader) (*AddrSpec, error) {
+	header := []byte{0, 0, 0}
+	if _, err := io.ReadAtLeast(r, header, 3); err != nil {
+		return nil, fmt.Errorf("failed to get reply: %v", err)
+	}
+
+	// Ensure we are compatible
+	if header[0] != socks5Version {
+		return nil, fmt.Errorf("unsupported reply version: %v", header[0])
+	}
+
+	// Read the bound address
+	addr, err := ReadAddrSpec(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read bound address: %v", err)
+	}
+	if header[1] != SuccessReply {
+		return addr, &ReplyError{Code: header[1]}
+	}
+	return addr, nil
+}
+
+// AppendAddrSpec is used to append AddrSpec to b.
+// Writes an address type byte, followed by the address and port
+func AppendAddrSpec(b []byte, addr *AddrSpec) ([]byte, error) {
 	// Format the address
 	var addrType uint8
 	var addrBody []byte
@@ -338,31 +562,33 @@ func sendReply(w io.Writer, resp uint8, addr *AddrSpec) error {
 		addrPort = uint16(addr.Port)
 
 	default:
-		return fmt.Errorf("failed to format address: %v", addr)
+		return nil, fmt.Errorf("failed to format address: %v", addr)
 	}
 
-	// Format the message
-	msg := make([]byte, 6+len(addrBody))
-	msg[0] = socks5Version
-	msg[1] = resp
-	msg[2] = 0 // Reserved
-	msg[3] = addrType
-	copy(msg[4:], addrBody)
-	msg[4+len(addrBody)] = byte(addrPort >> 8)
-	msg[4+len(addrBody)+1] = byte(addrPort & 0xff)
+	b = append(b, addrType)
+	b = append(b, addrBody...)
+	return append(b, byte(addrPort>>8), byte(addrPort&0xff)), nil
+}
 
-	// Send the message
-	_, err := w.Write(msg)
-	return err
+// bindIP returns the address used for bind and associate listeners.
+// Falls back to the local address of the client connection.
+func (s *Server) bindIP(conn conn) net.IP {
+	if len(s.config.BindIP) != 0 {
+		return s.config.BindIP
+	}
+	if local, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		return local.IP
+	}
+	return net.IPv4zero
 }
 
 type closeWriter interface {
 	CloseWrite() error
 }
 
-// proxy is used to send data from src to destination, and sends errors down a dedicated channel
-func proxy(lg *logger.Logger, dst io.Writer, src io.Reader, errCh chan error) {
-	_, err := io.Copy(dst, src)
+// proxy is used to send data from src to destination with copyData, and sends errors down a dedicated channel.
+func proxy(lg *logger.Logger, dst io.Writer, src io.Reader, copyData func(dst io.Writer, src io.Reader) error, errCh chan error) {
+	err := copyData(dst, src)
 	if tcpConn, ok := dst.(closeWriter); ok {
 		err = tcpConn.CloseWrite()
 		if err != nil {
@@ -373,3 +599,21 @@ func proxy(lg *logger.Logger, dst io.Writer, src io.Reader, errCh chan error) {
 	}
 	errCh <- err
 }
+
+// relay is used to proxy data between the client and the target in both directions
+// counting the traffic
+func relay(req *Request, conn conn, target net.Conn, traffic *trafficCounter) error {
+	errCh := make(chan error, 2)
+	go proxy(req.Lg, target, req.bufConn, traffic.copyUp, errCh)
+	go proxy(req.Lg, conn, target, traffic.copyDown, errCh)
+
+	// Wait
+	for i := 0; i < 2; i++ {
+		e := <-errCh
+		if e != nil {
+			// return from this function closes target (and conn).
+			return e
+		}
+	}
+	return nil
+}
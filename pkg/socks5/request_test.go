@@ -2,11 +2,20 @@ package socks5
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/dossif/gosocks5/pkg/logger"
+	"github.com/google/uuid"
 	"io"
 	"net"
+	"os"
+	"reflect"
 	"strings"
+	"syscall"
 	"testing"
+	"time"
 )
 
 type MockConn struct {
@@ -21,6 +30,18 @@ func (m *MockConn) RemoteAddr() net.Addr {
 	return &net.TCPAddr{IP: []byte{127, 0, 0, 1}, Port: 65432}
 }
 
+func (m *MockConn) LocalAddr() net.Addr {
+	return &net.TCPAddr{IP: []byte{127, 0, 0, 1}, Port: 1080}
+}
+
+func testLogger(t *testing.T) *logger.Logger {
+	lg, err := logger.NewLogger("debug")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return lg
+}
+
 func TestRequest_Connect(t *testing.T) {
 	// Create a local listener
 	l, err := net.Listen("tcp", "127.0.0.1:0")
@@ -30,24 +51,27 @@ func TestRequest_Connect(t *testing.T) {
 	go func() {
 		conn, err := l.Accept()
 		if err != nil {
-			t.Fatalf("err: %v", err)
+			t.Errorf("err: %v", err)
+			return
 		}
 		defer conn.Close()
 
 		buf := make([]byte, 4)
 		if _, err := io.ReadAtLeast(conn, buf, 4); err != nil {
-			t.Fatalf("err: %v", err)
+			t.Errorf("err: %v", err)
+			return
 		}
 
 		if !bytes.Equal(buf, []byte("ping")) {
-			t.Fatalf("bad: %v", buf)
+			t.Errorf("bad: %v", buf)
+			return
 		}
 		conn.Write([]byte("pong"))
 	}()
 	lAddr := l.Addr().(*net.TCPAddr)
 
 	// Make server
-	s := &Server{config: &Config{
+	s := &Server{ctx: context.Background(), config: &Config{
 		Rules:    PermitAll(),
 		Resolver: DNSResolver{},
 	}}
@@ -65,12 +89,12 @@ func TestRequest_Connect(t *testing.T) {
 
 	// Handle the request
 	resp := &MockConn{}
-	req, err := NewRequest(buf)
+	req, err := NewRequest(uuid.New(), testLogger(t), buf)
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
-	if err := s.handleRequest(req, resp); err != nil {
+	if err := s.handleRequest(context.Background(), req, resp); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
@@ -104,24 +128,27 @@ func TestRequest_Connect_RuleFail(t *testing.T) {
 	go func() {
 		conn, err := l.Accept()
 		if err != nil {
-			t.Fatalf("err: %v", err)
+			t.Errorf("err: %v", err)
+			return
 		}
 		defer conn.Close()
 
 		buf := make([]byte, 4)
 		if _, err := io.ReadAtLeast(conn, buf, 4); err != nil {
-			t.Fatalf("err: %v", err)
+			t.Errorf("err: %v", err)
+			return
 		}
 
 		if !bytes.Equal(buf, []byte("ping")) {
-			t.Fatalf("bad: %v", buf)
+			t.Errorf("bad: %v", buf)
+			return
 		}
 		conn.Write([]byte("pong"))
 	}()
 	lAddr := l.Addr().(*net.TCPAddr)
 
 	// Make server
-	s := &Server{config: &Config{
+	s := &Server{ctx: context.Background(), config: &Config{
 		Rules:    PermitNone(),
 		Resolver: DNSResolver{},
 	}}
@@ -139,12 +166,12 @@ func TestRequest_Connect_RuleFail(t *testing.T) {
 
 	// Handle the request
 	resp := &MockConn{}
-	req, err := NewRequest(buf)
+	req, err := NewRequest(uuid.New(), testLogger(t), buf)
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
-	if err := s.handleRequest(req, resp); !strings.Contains(err.Error(), "blocked by rules") {
+	if err := s.handleRequest(context.Background(), req, resp); !strings.Contains(err.Error(), "blocked by rules") {
 		t.Fatalf("err: %v", err)
 	}
 
@@ -163,3 +190,312 @@ func TestRequest_Connect_RuleFail(t *testing.T) {
 		t.Fatalf("bad: %v %v", out, expected)
 	}
 }
+
+func TestRequest_Connect_ReplyError(t *testing.T) {
+	// Make server with a dialer which fails like an upstream proxy
+	s := &Server{ctx: context.Background(), config: &Config{
+		Rules:    PermitAll(),
+		Resolver: DNSResolver{},
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return nil, fmt.Errorf("upstream: %w", &ReplyError{Code: TTLExpired})
+		},
+	}}
+
+	// Create the connect request
+	buf := bytes.NewBuffer(nil)
+	buf.Write([]byte{5, 1, 0, 1, 127, 0, 0, 1, 0, 80})
+
+	// Handle the request
+	resp := &MockConn{}
+	req, err := NewRequest(uuid.New(), testLogger(t), buf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if err := s.handleRequest(context.Background(), req, resp); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	// Verify response
+	out := resp.buf.Bytes()
+	if !bytes.Equal(out, []byte{5, TTLExpired, 0, 1, 0, 0, 0, 0, 0, 0}) {
+		t.Fatalf("bad: %v", out)
+	}
+}
+
+type failResolver struct{}
+
+func (failResolver) Resolve(ctx context.Context, name string) (context.Context, []net.IP, error) {
+	return ctx, nil, fmt.Errorf("unexpected lookup of %v", name)
+}
+
+// onionRule leaves .onion names to the upstream
+type onionRule struct{}
+
+func (onionRule) Allow(ctx context.Context, req *Request) (context.Context, bool) {
+	return ctx, true
+}
+
+func (onionRule) RemoteResolve(_ context.Context, req *Request) bool {
+	return strings.HasSuffix(req.DestAddr.FQDN, ".onion")
+}
+
+func TestRequest_Connect_RemoteResolve(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		fqdn string
+		conf Config
+	}{
+		{"server", "example.com", Config{Rules: PermitAll(), RemoteResolve: true}},
+		{"rule", "example.onion", Config{Rules: onionRule{}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// Make server with a dialer which expects the FQDN
+			var dialed string
+			conf := tc.conf
+			conf.Resolver = failResolver{}
+			conf.Dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+				dialed = addr
+				client, server := net.Pipe()
+				server.Close()
+				return client, nil
+			}
+			s := &Server{ctx: context.Background(), config: &conf}
+
+			// Create the connect request
+			buf := bytes.NewBuffer(nil)
+			buf.Write([]byte{5, 1, 0, 3, byte(len(tc.fqdn))})
+			buf.Write([]byte(tc.fqdn))
+			buf.Write([]byte{0, 80})
+
+			resp := &MockConn{}
+			req, err := NewRequest(uuid.New(), testLogger(t), buf)
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			if err := s.handleRequest(context.Background(), req, resp); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			if dialed != net.JoinHostPort(tc.fqdn, "80") {
+				t.Fatalf("bad: %v", dialed)
+			}
+			if req.DestAddr.IP != nil || req.DestAddr.String() != tc.fqdn+":80" {
+				t.Fatalf("bad: %v", req.DestAddr)
+			}
+			if out := resp.buf.Bytes(); out[1] != SuccessReply {
+				t.Fatalf("bad: %v", out)
+			}
+		})
+	}
+
+	// Without the option the name is resolved
+	s := &Server{ctx: context.Background(), config: &Config{Rules: onionRule{}, Resolver: failResolver{}}}
+	buf := bytes.NewBuffer(nil)
+	buf.Write([]byte{5, 1, 0, 3, 11})
+	buf.Write([]byte("example.com"))
+	buf.Write([]byte{0, 80})
+	req, err := NewRequest(uuid.New(), testLogger(t), buf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp := &MockConn{}
+	if err := s.handleRequest(context.Background(), req, resp); err == nil {
+		t.Fatalf("expected error")
+	}
+	if out := resp.buf.Bytes(); out[1] != HostUnreachable {
+		t.Fatalf("bad: %v", out)
+	}
+}
+
+// phaseRule records the phases and denies loopback addresses after resolution
+type phaseRule struct {
+	phases []RulePhase
+	deny   string
+}
+
+func (p *phaseRule) Allow(ctx context.Context, req *Request) (context.Context, bool) {
+	p.phases = append(p.phases, req.Phase)
+	switch req.Phase {
+	case PreResolve:
+		return ctx, req.DestAddr.FQDN != p.deny
+	case PostResolve:
+		return ctx, !req.DestAddr.IP.IsLoopback()
+	default:
+		return ctx, req.RealDestAddr().Port != 22
+	}
+}
+
+type countingResolver struct {
+	ips     []net.IP
+	lookups int
+}
+
+func (r *countingResolver) Resolve(ctx context.Context, _ string) (context.Context, []net.IP, error) {
+	r.lookups++
+	return ctx, r.ips, nil
+}
+
+type portRewriter int
+
+func (p portRewriter) Rewrite(ctx context.Context, req *Request) (context.Context, *AddrSpec) {
+	return ctx, &AddrSpec{IP: req.DestAddr.IP, Port: int(p)}
+}
+
+func TestRequest_RulePhases(t *testing.T) {
+	public := net.ParseIP("192.0.2.1")
+	for _, tc := range []struct {
+		name     string
+		fqdn     string
+		ips      []net.IP
+		rewrite  AddressRewriter
+		lookups  int
+		phases   []RulePhase
+		expected uint8
+	}{
+		{"blocked name", "blocked.test", []net.IP{public}, nil, 0, []RulePhase{PreResolve}, RuleFailure},
+		{"rebinding", "example.test", []net.IP{public, net.IPv4(127, 0, 0, 1)}, nil, 1, []RulePhase{PreResolve, PostResolve, PostResolve}, RuleFailure},
+		{"rewritten", "example.test", []net.IP{public}, portRewriter(22), 1, []RulePhase{PreResolve, PostResolve, Final}, RuleFailure},
+		{"allowed", "example.test", []net.IP{public}, nil, 1, []RulePhase{PreResolve, PostResolve, Final}, ConnectionRefused},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rules := &phaseRule{deny: "blocked.test"}
+			resolver := &countingResolver{ips: tc.ips}
+			s := &Server{ctx: context.Background(), config: &Config{
+				Rules:    rules,
+				Resolver: resolver,
+				Rewriter: tc.rewrite,
+				Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					return nil, &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+				},
+			}}
+
+			buf := bytes.NewBuffer(nil)
+			buf.Write([]byte{5, 1, 0, 3, byte(len(tc.fqdn))})
+			buf.Write([]byte(tc.fqdn))
+			buf.Write([]byte{0, 80})
+			req, err := NewRequest(uuid.New(), testLogger(t), buf)
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			resp := &MockConn{}
+			if err := s.handleRequest(context.Background(), req, resp); err == nil {
+				t.Fatalf("expected error")
+			}
+			if out := resp.buf.Bytes(); out[1] != tc.expected {
+				t.Fatalf("bad: %v", out)
+			}
+			if resolver.lookups != tc.lookups {
+				t.Fatalf("bad lookups: %v", resolver.lookups)
+			}
+			if !reflect.DeepEqual(rules.phases, tc.phases) {
+				t.Fatalf("bad phases: %v", rules.phases)
+			}
+		})
+	}
+}
+
+type ctxKey string
+
+// ctxResolver adds a value to the context seen by the later stages
+type ctxResolver struct{}
+
+func (ctxResolver) Resolve(ctx context.Context, _ string) (context.Context, []net.IP, error) {
+	return context.WithValue(ctx, ctxKey("resolve"), true), []net.IP{net.ParseIP("192.0.2.1")}, nil
+}
+
+type ctxRewriter struct{}
+
+func (ctxRewriter) Rewrite(ctx context.Context, req *Request) (context.Context, *AddrSpec) {
+	return context.WithValue(ctx, ctxKey("rewrite"), ctx.Value(ctxKey("resolve"))), req.DestAddr
+}
+
+type ctxRule struct{}
+
+func (ctxRule) Allow(ctx context.Context, req *Request) (context.Context, bool) {
+	if req.Phase != Final {
+		return ctx, true
+	}
+	return context.WithValue(ctx, ctxKey("rules"), ctx.Value(ctxKey("rewrite"))), true
+}
+
+func TestRequest_ContextValues(t *testing.T) {
+	var values []interface{}
+	s := &Server{ctx: context.Background(), config: &Config{
+		Rules:    ctxRule{},
+		Resolver: ctxResolver{},
+		Rewriter: ctxRewriter{},
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			for _, key := range []string{"request", "resolve", "rewrite", "rules"} {
+				values = append(values, ctx.Value(ctxKey(key)))
+			}
+			return nil, &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+		},
+	}}
+
+	buf := bytes.NewBuffer([]byte{5, 1, 0, 3, 7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 0, 80})
+	req, err := NewRequest(uuid.New(), testLogger(t), buf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	ctx := context.WithValue(context.Background(), ctxKey("request"), true)
+	if err := s.handleRequest(ctx, req, &MockConn{}); err == nil {
+		t.Fatalf("expected error")
+	}
+	if expected := []interface{}{true, true, true, true}; !reflect.DeepEqual(values, expected) {
+		t.Fatalf("bad: %v", values)
+	}
+}
+
+func TestServeConnection_CancelDial(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		disconnect bool
+	}{
+		{"client disconnect", true},
+		{"server shutdown", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			dialing := make(chan struct{})
+			cancelled := make(chan error, 1)
+			s, _ := New(ctx, testLogger(t), &Config{
+				Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					close(dialing)
+					<-ctx.Done()
+					cancelled <- ctx.Err()
+					return nil, ctx.Err()
+				},
+				DialTimeout: time.Minute,
+			})
+			client, server := net.Pipe()
+			defer client.Close()
+			go func() {
+				_ = s.ServeConnection(Connection{Lg: testLogger(t), conn: server})
+			}()
+
+			client.SetDeadline(time.Now().Add(time.Second))
+			client.Write([]byte{socks5Version, 1, NoAuth})
+			out := make([]byte, 2)
+			if _, err := io.ReadAtLeast(client, out, len(out)); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			client.Write([]byte{5, 1, 0, 1, 192, 0, 2, 1, 0, 80})
+			<-dialing
+			if tc.disconnect {
+				client.Close()
+			} else {
+				cancel()
+			}
+
+			select {
+			case err := <-cancelled:
+				if !errors.Is(err, context.Canceled) {
+					t.Fatalf("bad: %v", err)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("dial is not cancelled")
+			}
+		})
+	}
+}
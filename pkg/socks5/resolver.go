@@ -1,23 +1,23 @@
 package socks5
 
 import (
+	"context"
 	"net"
-
-	"golang.org/x/net/context"
 )
 
-// NameResolver is used to implement custom name resolution
+// NameResolver is used to implement custom name resolution.
+// Resolve returns all IPv4 and IPv6 addresses of the name.
 type NameResolver interface {
-	Resolve(ctx context.Context, name string) (context.Context, net.IP, error)
+	Resolve(ctx context.Context, name string) (context.Context, []net.IP, error)
 }
 
 // DNSResolver uses the system DNS to resolve host names
 type DNSResolver struct{}
 
-func (d DNSResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
-	addr, err := net.ResolveIPAddr("ip", name)
+func (d DNSResolver) Resolve(ctx context.Context, name string) (context.Context, []net.IP, error) {
+	addrs, err := net.DefaultResolver.LookupIP(ctx, "ip", name)
 	if err != nil {
 		return ctx, nil, err
 	}
-	return ctx, addr.IP, err
+	return ctx, addrs, nil
 }
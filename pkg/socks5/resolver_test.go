@@ -1,21 +1,25 @@
 package socks5
 
 import (
+	"context"
 	"testing"
-
-	"golang.org/x/net/context"
 )
 
 func TestDNSResolver(t *testing.T) {
 	d := DNSResolver{}
 	ctx := context.Background()
 
-	_, addr, err := d.Resolve(ctx, "localhost")
+	_, addrs, err := d.Resolve(ctx, "localhost")
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
-	if !addr.IsLoopback() {
-		t.Fatalf("expected loopback")
+	if len(addrs) == 0 {
+		t.Fatalf("expected addresses")
+	}
+	for _, addr := range addrs {
+		if !addr.IsLoopback() {
+			t.Fatalf("expected loopback: %v", addr)
+		}
 	}
 }
@@ -1,14 +1,48 @@
 package socks5
 
 import (
-	"golang.org/x/net/context"
+	"context"
+	"fmt"
 )
 
-// RuleSet is used to provide custom rules to allow or prohibit actions
+// RuleSet is used to provide custom rules to allow or prohibit actions.
+// Allow is called once per phase, the phase is in Request.Phase.
 type RuleSet interface {
 	Allow(ctx context.Context, req *Request) (context.Context, bool)
 }
 
+// RulePhase is the step of the request pipeline the rules are evaluated in
+type RulePhase uint8
+
+const (
+	// PreResolve checks the requested destination before any DNS lookup,
+	// DestAddr.IP is empty for FQDN destinations
+	PreResolve RulePhase = iota
+	// PostResolve checks every resolved address of the FQDN in turn
+	// as DestAddr.IP, the request is denied if any address is denied
+	PostResolve
+	// Final checks the actual destination after rewrites, see Request.RealDestAddr
+	Final
+)
+
+func (p RulePhase) String() string {
+	switch p {
+	case PreResolve:
+		return "pre-resolve"
+	case PostResolve:
+		return "post-resolve"
+	case Final:
+		return "final"
+	}
+	return fmt.Sprintf("unknown phase %d", uint8(p))
+}
+
+// ResolvePolicy can be implemented by a RuleSet to skip local resolution
+// of the destination FQDN per request, see Config.RemoteResolve
+type ResolvePolicy interface {
+	RemoteResolve(ctx context.Context, req *Request) bool
+}
+
 // PermitAll returns a RuleSet which allows all types of connections
 func PermitAll() RuleSet {
 	return &PermitCommand{true, true, true}
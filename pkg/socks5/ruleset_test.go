@@ -1,9 +1,8 @@
 package socks5
 
 import (
+	"context"
 	"testing"
-
-	"golang.org/x/net/context"
 )
 
 func TestPermitCommand(t *testing.T) {
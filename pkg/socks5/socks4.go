@@ -0,0 +1,122 @@
+package socks5
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"github.com/dossif/gosocks5/pkg/logger"
+	"github.com/google/uuid"
+	"io"
+	"net"
+)
+
+const (
+	socks4Version      = uint8(4)
+	socks4ReplyVersion = uint8(0)
+	socks4Granted      = uint8(90)
+	socks4Rejected     = uint8(91)
+	// socks4MaxField limits the length of USERID and hostname fields
+	socks4MaxField = 255
+)
+
+// readSocks4Request is used to read a SOCKS4 or SOCKS4a request.
+// SOCKS4 has no authentication, so it is served only when "auth-less" mode
+// is enabled for the client.
+func (s *Server) readSocks4Request(conn Connection, bufConn *bufio.Reader) (*Request, error) {
+	if !s.allowsAnonymous(conn.info()) {
+		s.metrics().AuthResult(NoAcceptable, false)
+		if err := sendSocks4Reply(conn.conn, RuleFailure, nil); err != nil {
+			return nil, fmt.Errorf("failed to send reply: %v", err)
+		}
+		return nil, fmt.Errorf("socks4 is not allowed: %v", NoSupportedAuth)
+	}
+	s.metrics().AuthResult(NoAuth, true)
+	reqId := uuid.New()
+	l := *conn.Lg
+	l.AddField(map[string]string{"reqId": reqId.String()})
+	request, err := NewSocks4Request(reqId, &l, bufConn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read socks4 request: %v", err)
+	}
+	l.AddField(map[string]string{"user": request.AuthContext.Payload["UserId"]})
+	return request, nil
+}
+
+// NewSocks4Request creates a new Request from a SOCKS4 tcp connection.
+// Expects the version byte to be already consumed.
+func NewSocks4Request(id uuid.UUID, lg *logger.Logger, bufConn io.Reader) (*Request, error) {
+	// Read the command, port and ip
+	header := make([]byte, 7)
+	if _, err := io.ReadAtLeast(bufConn, header, len(header)); err != nil {
+		return nil, fmt.Errorf("failed to get command: %v", err)
+	}
+	dest := &AddrSpec{
+		IP:   net.IP(header[3:7]),
+		Port: int(binary.BigEndian.Uint16(header[1:3])),
+	}
+
+	// Read the user id
+	userId, err := readNullString(bufConn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user id: %v", err)
+	}
+
+	// SOCKS4a sends the hostname after an ip of 0.0.0.x
+	if dest.IP[0] == 0 && dest.IP[1] == 0 && dest.IP[2] == 0 && dest.IP[3] != 0 {
+		fqdn, err := readNullString(bufConn)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get hostname: %v", err)
+		}
+		dest = &AddrSpec{FQDN: fqdn, Port: dest.Port}
+	}
+
+	request := &Request{
+		Id:          id,
+		Lg:          lg,
+		Version:     socks4Version,
+		Command:     header[0],
+		AuthContext: &AuthContext{NoAuth, map[string]string{"UserId": userId}},
+		DestAddr:    dest,
+		bufConn:     bufConn,
+	}
+
+	return request, nil
+}
+
+// readNullString is used to read a null terminated string field
+func readNullString(r io.Reader) (string, error) {
+	var field []byte
+	b := []byte{0}
+	for {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", err
+		}
+		if b[0] == 0 {
+			return string(field), nil
+		}
+		if len(field) == socks4MaxField {
+			return "", fmt.Errorf("field is longer than %v bytes", socks4MaxField)
+		}
+		field = append(field, b[0])
+	}
+}
+
+// sendSocks4Reply is used to send a SOCKS4 reply message.
+// SOCKS4 has a single failure code, so any failure maps to rejected.
+func sendSocks4Reply(w io.Writer, resp uint8, addr *AddrSpec) error {
+	msg := make([]byte, 8)
+	msg[0] = socks4ReplyVersion
+	msg[1] = socks4Rejected
+	if resp == SuccessReply {
+		msg[1] = socks4Granted
+	}
+	if addr != nil {
+		binary.BigEndian.PutUint16(msg[2:4], uint16(addr.Port))
+		if ip4 := addr.IP.To4(); ip4 != nil {
+			copy(msg[4:], ip4)
+		}
+	}
+
+	_, err := w.Write(msg)
+	return err
+}
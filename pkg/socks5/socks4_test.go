@@ -0,0 +1,136 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+type staticResolver []net.IP
+
+func (r staticResolver) Resolve(ctx context.Context, _ string) (context.Context, []net.IP, error) {
+	return ctx, r, nil
+}
+
+type userIdRule string
+
+func (u userIdRule) Allow(ctx context.Context, req *Request) (context.Context, bool) {
+	return ctx, req.AuthContext.Payload["UserId"] == string(u)
+}
+
+func TestNewSocks4Request(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	buf.Write([]byte{ConnectCommand, 0, 80, 0, 0, 0, 1})
+	buf.Write([]byte("foo\x00example.com\x00"))
+
+	req, err := NewSocks4Request([16]byte{}, nil, buf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if req.Version != socks4Version || req.Command != ConnectCommand {
+		t.Fatalf("bad: %v %v", req.Version, req.Command)
+	}
+	if req.DestAddr.FQDN != "example.com" || req.DestAddr.Port != 80 {
+		t.Fatalf("bad: %v", req.DestAddr)
+	}
+	if req.AuthContext.Payload["UserId"] != "foo" {
+		t.Fatalf("bad: %v", req.AuthContext.Payload)
+	}
+}
+
+func TestSOCKS4_Connect(t *testing.T) {
+	// Create a local listener
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	go func() {
+		conn, err := target.Accept()
+		if err != nil {
+			t.Errorf("err: %v", err)
+			return
+		}
+		defer conn.Close()
+		buf := make([]byte, 4)
+		if _, err := io.ReadAtLeast(conn, buf, 4); err != nil {
+			t.Errorf("err: %v", err)
+			return
+		}
+		conn.Write([]byte("pong"))
+	}()
+	tAddr := target.Addr().(*net.TCPAddr)
+
+	// Create a socks server
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	serv, err := New(ctx, testLogger(t), &Config{
+		Resolver: staticResolver{net.IPv4(127, 0, 0, 1)},
+		Rules:    userIdRule("foo"),
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	go func() {
+		_ = serv.ServeListener(l)
+	}()
+
+	for _, tc := range []struct {
+		userId   string
+		expected []byte
+	}{
+		{"bar", []byte{0, socks4Rejected, 0, 0, 0, 0, 0, 0}},
+		{"foo", []byte{0, socks4Granted, 0, 0, 127, 0, 0, 1, 'p', 'o', 'n', 'g'}},
+	} {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		conn.SetDeadline(time.Now().Add(time.Second))
+
+		// SOCKS4a connect by hostname
+		req := []byte{socks4Version, ConnectCommand, 0, 0, 0, 0, 0, 1}
+		binary.BigEndian.PutUint16(req[2:], uint16(tAddr.Port))
+		req = append(req, tc.userId+"\x00localhost\x00ping"...)
+		conn.Write(req)
+
+		out := make([]byte, len(tc.expected))
+		if _, err := io.ReadAtLeast(conn, out, len(out)); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		conn.Close()
+
+		// Ignore the port
+		out[2] = 0
+		out[3] = 0
+		if !bytes.Equal(out, tc.expected) {
+			t.Fatalf("bad: %v", out)
+		}
+	}
+}
+
+func TestSOCKS4_RequiresNoAuth(t *testing.T) {
+	s, _ := New(context.Background(), testLogger(t), &Config{Credentials: testCredentials{"foo": "bar"}})
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		_ = s.ServeConnection(Connection{Lg: testLogger(t), conn: server})
+	}()
+
+	client.SetDeadline(time.Now().Add(time.Second))
+	go client.Write([]byte{socks4Version, ConnectCommand, 0, 80, 127, 0, 0, 1, 0})
+	out := make([]byte, 8)
+	if _, err := io.ReadAtLeast(client, out, len(out)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out[1] != socks4Rejected {
+		t.Fatalf("bad: %v", out)
+	}
+}
@@ -2,30 +2,40 @@ package socks5
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"github.com/dossif/gosocks5/pkg/logger"
 	"github.com/google/uuid"
-	"golang.org/x/net/context"
+	"io"
 	"net"
-	"runtime"
 	"time"
 )
 
 const (
-	socks5Version = uint8(5)
-	connDeadline  = time.Second * 10
+	socks5Version         = uint8(5)
+	connDeadline          = time.Second * 10
+	defaultBindTimeout    = time.Minute * 2
+	defaultUDPIdleTimeout = time.Minute
+	defaultUDPMaxDests    = 256
 )
 
-var ConnCount int
-
 // Config is used to set up and configure a Server
 type Config struct {
 	// AuthMethods can be provided to implement custom authentication
 	// By default, "auth-less" mode is enabled.
 	// For password-based auth use UserPassAuthenticator.
+	// The order is the server preference: the first of them
+	// offered by the client is selected.
 	AuthMethods []Authenticator
 
+	// AuthPolicies restrict auth methods by the client network,
+	// e.g. "auth-less" mode only from trusted networks.
+	// The first policy matching the client address applies,
+	// clients matching no policy may use any of AuthMethods.
+	AuthPolicies []AuthPolicy
+
 	// If provided, username/password authentication is enabled,
 	// by appending a UserPassAuthenticator to AuthMethods. If not provided,
 	// and AUthMethods is nil, then "auth-less" mode is enabled.
@@ -39,6 +49,14 @@ type Config struct {
 	// various commands. If not provided, PermitAll is used.
 	Rules RuleSet
 
+	// RemoteResolve skips local resolution of connect destinations, so
+	// Dial receives the FQDN and the upstream resolves it. Rules and rewrites
+	// see the request without an IP and the PostResolve phase is skipped,
+	// so rules on destination IPs are not enforced. Without Dial the system
+	// resolver of the default dialer resolves the name, bypassing Resolver.
+	// A RuleSet can decide per request by implementing ResolvePolicy.
+	RemoteResolve bool
+
 	// Rewriter can be used to transparently rewrite addresses.
 	// This is invoked before the RuleSet is invoked.
 	// Defaults to NoRewrite.
@@ -47,6 +65,54 @@ type Config struct {
 	// BindIP is used for bind or udp associate
 	BindIP net.IP
 
+	// BindTimeout limits how long a bind command waits for
+	// the incoming connection. Defaults to 2 minutes.
+	BindTimeout time.Duration
+
+	// UDPIdleTimeout is used to expire udp associate destinations
+	// without traffic. Defaults to 1 minute.
+	UDPIdleTimeout time.Duration
+
+	// UDPMaxDestinations limits the destinations of a udp association
+	// with open sockets or being opened. Defaults to 256.
+	UDPMaxDestinations int
+
+	// FamilyPreference selects the address family dialed first
+	// when the destination has IPv4 and IPv6 addresses. Defaults to PreferIPv6.
+	FamilyPreference FamilyPreference
+
+	// DialTimeout limits a single connection attempt. Defaults to 10 seconds.
+	DialTimeout time.Duration
+
+	// FallbackDelay is the delay before the next address is tried
+	// while the previous attempt is in progress. Defaults to 250ms.
+	FallbackDelay time.Duration
+
+	// GlobalRateLimit limits the relayed bandwidth of all clients together
+	GlobalRateLimit RateLimit
+
+	// UserRateLimit limits the relayed bandwidth of each authenticated user,
+	// shared by all connections of the user. It can be overridden per user
+	// by a CredentialStore implementing RateLimitStore.
+	UserRateLimit RateLimit
+
+	// ConnQuota limits the concurrent connections in total, per client ip
+	// and per authenticated user. Over-limit clients get a failure reply.
+	ConnQuota ConnQuota
+
+	// Traffic receives the bytes relayed by every session, optional
+	Traffic TrafficRecorder
+
+	// DataQuota limits the data of users, optional.
+	// New connect and associate requests over the quota are refused.
+	DataQuota DataQuota
+
+	// CloseOverQuota closes the active sessions of users once they are over DataQuota
+	CloseOverQuota bool
+
+	// Metrics observes connections, auth, replies, dials and relayed bytes, optional
+	Metrics Metrics
+
 	// Optional function for dialing out
 	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
 }
@@ -59,12 +125,38 @@ type Server struct {
 	Lg          *logger.Logger
 	config      *Config
 	authMethods map[uint8]Authenticator
+	// authOrder is the server preference of auth methods
+	authOrder []uint8
+	limits    *rateLimiter
+	admission *admission
 }
 
 type Connection struct {
-	id   uuid.UUID
-	Lg   *logger.Logger
-	conn net.Conn
+	id       uuid.UUID
+	Lg       *logger.Logger
+	conn     net.Conn
+	listener string
+}
+
+// tlsConn is implemented by connections which carry a tls session
+type tlsConn interface {
+	ConnectionState() tls.ConnectionState
+}
+
+// info returns the connection info passed to authenticators.
+// The tls state is complete after the handshake, which is done on the first read.
+func (c Connection) info() *ConnInfo {
+	info := &ConnInfo{
+		ID:         c.id,
+		Listener:   c.listener,
+		RemoteAddr: c.conn.RemoteAddr(),
+		LocalAddr:  c.conn.LocalAddr(),
+	}
+	if t, ok := c.conn.(tlsConn); ok {
+		state := t.ConnectionState()
+		info.TLS = &state
+	}
+	return info
 }
 
 // New creates a new Server and potentially returns an error
@@ -88,19 +180,59 @@ func New(ctx context.Context, lg *logger.Logger, conf *Config) (*Server, error)
 		conf.Rules = PermitAll()
 	}
 
+	if conf.BindTimeout == 0 {
+		conf.BindTimeout = defaultBindTimeout
+	}
+
+	if conf.UDPIdleTimeout == 0 {
+		conf.UDPIdleTimeout = defaultUDPIdleTimeout
+	}
+
+	if conf.UDPMaxDestinations == 0 {
+		conf.UDPMaxDestinations = defaultUDPMaxDests
+	}
+
+	if conf.DialTimeout == 0 {
+		conf.DialTimeout = defaultDialTimeout
+	}
+
+	if conf.FallbackDelay == 0 {
+		conf.FallbackDelay = defaultFallbackDelay
+	}
+
 	server := &Server{
-		id:     uuid.New(),
-		config: conf,
-		ctx:    ctx,
-		Lg:     lg,
+		id:        uuid.New(),
+		config:    conf,
+		ctx:       ctx,
+		Lg:        lg,
+		limits:    newRateLimiter(conf.GlobalRateLimit),
+		admission: newAdmission(conf.ConnQuota),
 	}
 
 	server.authMethods = make(map[uint8]Authenticator)
 
 	for _, a := range conf.AuthMethods {
+		switch a.(type) {
+		case TokenAuthenticator, *TokenAuthenticator:
+			if code := a.GetCode(); code < TokenAuth || code == NoAcceptable {
+				return nil, fmt.Errorf("token auth: method %#x is not a private method code 0x80-0xfe", code)
+			}
+		}
+		if _, found := server.authMethods[a.GetCode()]; !found {
+			server.authOrder = append(server.authOrder, a.GetCode())
+		}
 		server.authMethods[a.GetCode()] = a
 	}
 
+	// Ensure auth policies refer to the configured methods
+	for _, p := range conf.AuthPolicies {
+		for _, method := range p.Methods {
+			if _, found := server.authMethods[method]; !found {
+				return nil, fmt.Errorf("auth policy for %v: method %v is not configured", p.Networks, method)
+			}
+		}
+	}
+
 	return server, nil
 }
 
@@ -113,25 +245,26 @@ func (s *Server) ListenAndServe(network, addr string) error {
 	} else {
 		s.Lg.Lg.Info().Msgf("start new %v listener on %v", network, addr)
 	}
-	go func() {
-		for {
-			var m runtime.MemStats
-			runtime.ReadMemStats(&m)
-			s.Lg.Lg.Trace().
-				Int("conn", ConnCount).
-				Int("gorutines", runtime.NumGoroutine()).
-				Uint64("memTotalAllocMiB", m.TotalAlloc/1024/1024).
-				Uint64("memSysMiB", m.Sys/1024/1024).
-				Uint32("memNumGc", m.NumGC).
-				Msgf("statistics")
-			time.Sleep(time.Second * 5)
-		}
-	}()
 	return s.ServeListener(ll)
 }
 
-// ServeListener is used to serve connections from a listener
+// ListenAndServeTLS is used to create a TLS listener and serve on it.
+// Certificates are taken from conf, use tls.Config.GetCertificate to reload them.
+func (s *Server) ListenAndServeTLS(network, addr string, conf *tls.Config) error {
+	l := net.ListenConfig{KeepAlive: time.Second * 1}
+	ll, err := l.Listen(s.ctx, network, addr)
+	if err != nil {
+		return err
+	} else {
+		s.Lg.Lg.Info().Msgf("start new %v tls listener on %v", network, addr)
+	}
+	return s.ServeListener(tls.NewListener(ll, conf))
+}
+
+// ServeListener is used to serve connections from a listener.
+// Connections are named after the listener address, see ConnInfo.
 func (s *Server) ServeListener(l net.Listener) error {
+	name := l.Addr().String()
 	go func() {
 		<-s.ctx.Done()
 		_ = l.Close()
@@ -153,9 +286,10 @@ func (s *Server) ServeListener(l net.Listener) error {
 		l.AddField(map[string]string{"connId": connId.String()})
 		go func() {
 			err := s.ServeConnection(Connection{
-				id:   connId,
-				Lg:   &l,
-				conn: conn,
+				id:       connId,
+				Lg:       &l,
+				conn:     conn,
+				listener: name,
 			})
 			if err != nil {
 				s.Lg.Lg.Warn().Msgf("failed to serve connection: %v", err)
@@ -166,17 +300,25 @@ func (s *Server) ServeListener(l net.Listener) error {
 
 // ServeConnection is used to serve a single connection.
 func (s *Server) ServeConnection(conn Connection) error {
-	ConnCount = ConnCount + 1
+	s.metrics().ConnOpened(conn.listener)
 	conn.Lg.Lg.Trace().Msgf("start connection")
 	defer func() {
+		s.metrics().ConnClosed(conn.listener)
 		err := conn.conn.Close()
 		if err != nil {
 			conn.Lg.Lg.Warn().Msgf("failed to close connection %v", err)
 		} else {
-			ConnCount = ConnCount - 1
 			conn.Lg.Lg.Trace().Msgf("close connection")
 		}
 	}()
+	// Count the connection, clients over quota are rejected before authentication
+	releaseConn, quotaErr := s.admission.admitConn(conn.conn.RemoteAddr())
+	defer releaseConn()
+
+	// The request context ends with the connection or on server shutdown
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+
 	bufConn := bufio.NewReader(conn.conn)
 
 	_ = conn.conn.SetReadDeadline(time.Now().Add(connDeadline))
@@ -186,39 +328,110 @@ func (s *Server) ServeConnection(conn Connection) error {
 	if _, err := bufConn.Read(version); err != nil {
 		return fmt.Errorf("failed to get version byte: %v", err)
 	}
+	if quotaErr != nil {
+		return rejectConn(conn.conn, version[0], bufConn, quotaErr)
+	}
 
-	// Ensure we are compatible
-	if version[0] != socks5Version {
+	// Read the request in the client protocol version
+	var request *Request
+	var err error
+	switch version[0] {
+	case socks5Version:
+		request, err = s.readRequest(ctx, conn, bufConn)
+	case socks4Version:
+		request, err = s.readSocks4Request(conn, bufConn)
+	default:
 		return fmt.Errorf("unsupported socks version: %v", version)
 	}
+	if err != nil {
+		return err
+	}
+	if client, ok := conn.conn.RemoteAddr().(*net.TCPAddr); ok {
+		request.RemoteAddr = &AddrSpec{IP: client.IP, Port: client.Port}
+	}
+	request.Lg.Lg.Debug().Msgf("%s -> %s", request.RemoteAddr, request.DestAddr)
+
+	// Count the user, requests over quota are rejected after authentication
+	releaseUser, err := s.admission.admitUser(requestUser(request))
+	defer releaseUser()
+	if err != nil {
+		replyErr := request.reply(conn.conn, ReplyCode(err), nil)
+		s.metrics().Reply(request.Reply)
+		if replyErr != nil {
+			return fmt.Errorf("failed to send reply: %v", replyErr)
+		}
+		return fmt.Errorf("rejected request: %w", err)
+	}
+
+	// The handshake is done, the deadline must not affect the relay
+	_ = conn.conn.SetReadDeadline(time.Time{})
+	request.unwatch = watchClient(cancel, conn.conn, bufConn)
+	defer request.stopWatch()
+
+	// Process the client request
+	err = s.handleRequest(ctx, request, conn.conn)
+	s.metrics().Reply(request.Reply)
+	request.Lg.Lg.Debug().Msgf("reply: %v", ReplyMessage(request.Reply))
+	if err != nil {
+		return fmt.Errorf("failed to handle request: %w", err)
+	}
+
+	return nil
+}
+
+// rejectConn answers a connection over quota in the client protocol version.
+// Before authentication SOCKS5 can only refuse all auth methods.
+func rejectConn(conn net.Conn, version uint8, bufConn io.Reader, reason error) error {
+	switch version {
+	case socks5Version:
+		if _, err := readMethods(bufConn); err == nil {
+			_ = noAcceptableAuth(conn)
+		}
+	case socks4Version:
+		_ = sendSocks4Reply(conn, RuleFailure, nil)
+	}
+	return fmt.Errorf("rejected connection: %w", reason)
+}
+
+// watchClient cancels the request context when the client disconnects
+// before the relay starts. The reader is only peeked, so no data is consumed.
+// The returned function stops watching.
+func watchClient(cancel context.CancelFunc, conn net.Conn, bufConn *bufio.Reader) func() {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var netErr net.Error
+		if _, err := bufConn.Peek(1); err != nil && !(errors.As(err, &netErr) && netErr.Timeout()) {
+			cancel()
+		}
+	}()
+	return func() {
+		// Interrupt the peek and wait for it before the reader is used again
+		_ = conn.SetReadDeadline(time.Now())
+		<-done
+		_ = conn.SetReadDeadline(time.Time{})
+	}
+}
 
+// readRequest is used to authenticate a SOCKS5 connection and read its request
+func (s *Server) readRequest(ctx context.Context, conn Connection, bufConn *bufio.Reader) (*Request, error) {
 	// Authenticate the connection
-	authContext, user, err := s.authenticate(conn.conn, bufConn)
+	authContext, user, err := s.authenticate(ctx, conn.info(), conn.conn, bufConn)
 	if err != nil {
-		return fmt.Errorf("failed to authenticate: %v", err)
+		return nil, fmt.Errorf("failed to authenticate: %v", err)
 	}
 	reqId := uuid.New()
 	l := *conn.Lg
 	l.AddField(map[string]string{"reqId": reqId.String(), "user": user})
 	request, err := NewRequest(reqId, &l, bufConn)
 	if err != nil {
-		if errors.Is(err, unrecognizedAddrType) {
-			if err := sendReply(conn.conn, addrTypeNotSupported, nil); err != nil {
-				return fmt.Errorf("failed to send reply: %v", err)
+		if errors.Is(err, UnrecognizedAddrType) {
+			if err := sendReply(conn.conn, AddrTypeNotSupported, nil); err != nil {
+				return nil, fmt.Errorf("failed to send reply: %v", err)
 			}
 		}
-		return fmt.Errorf("failed to read destination address: %v", err)
+		return nil, fmt.Errorf("failed to read destination address: %v", err)
 	}
 	request.AuthContext = authContext
-	if client, ok := conn.conn.RemoteAddr().(*net.TCPAddr); ok {
-		request.RemoteAddr = &AddrSpec{IP: client.IP, Port: client.Port}
-	}
-	l.Lg.Debug().Msgf("%s -> %s", request.RemoteAddr, request.DestAddr)
-
-	// Process the client request
-	if err := s.handleRequest(request, conn.conn); err != nil {
-		return fmt.Errorf("failed to handle request: %v", err)
-	}
-
-	return nil
+	return request, nil
 }
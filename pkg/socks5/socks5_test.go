@@ -3,10 +3,17 @@ package socks5
 import (
 	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/binary"
-	"github.com/dossif/gosocks5/pkg/logger"
 	"io"
+	"math/big"
 	"net"
+	"strconv"
 	"testing"
 	"time"
 )
@@ -20,17 +27,20 @@ func TestSOCKS5_Connect(t *testing.T) {
 	go func() {
 		conn, err := l.Accept()
 		if err != nil {
-			t.Fatalf("err: %v", err)
+			t.Errorf("err: %v", err)
+			return
 		}
 		defer conn.Close()
 
 		buf := make([]byte, 4)
 		if _, err := io.ReadAtLeast(conn, buf, 4); err != nil {
-			t.Fatalf("err: %v", err)
+			t.Errorf("err: %v", err)
+			return
 		}
 
 		if !bytes.Equal(buf, []byte("ping")) {
-			t.Fatalf("bad: %v", buf)
+			t.Errorf("bad: %v", buf)
+			return
 		}
 		conn.Write([]byte("pong"))
 	}()
@@ -40,13 +50,11 @@ func TestSOCKS5_Connect(t *testing.T) {
 	creds := testCredentials{
 		"foo": "bar",
 	}
-	lg, err := logger.NewLogger("debug")
 	cator := UserPassAuthenticator{Credentials: creds}
 	conf := &Config{
 		AuthMethods: []Authenticator{cator},
-		Logger:      lg,
 	}
-	serv, err := New(context.Background(), conf)
+	serv, err := New(context.Background(), testLogger(t), conf)
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
@@ -54,7 +62,8 @@ func TestSOCKS5_Connect(t *testing.T) {
 	// Start listening
 	go func() {
 		if err := serv.ListenAndServe("tcp", "127.0.0.1:12365"); err != nil {
-			t.Fatalf("err: %v", err)
+			t.Errorf("err: %v", err)
+			return
 		}
 	}()
 	time.Sleep(10 * time.Millisecond)
@@ -109,3 +118,136 @@ func TestSOCKS5_Connect(t *testing.T) {
 		t.Fatalf("bad: %v", out)
 	}
 }
+
+func TestSOCKS5_Bind(t *testing.T) {
+	// Create a socks server
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	serv, err := New(ctx, testLogger(t), &Config{BindIP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	go func() {
+		_ = serv.ServeListener(l)
+	}()
+
+	// Get a local conn
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+
+	// Connect, auth and bind expecting a peer from localhost
+	conn.Write([]byte{5, 1, NoAuth})
+	conn.Write([]byte{5, 2, 0, 1, 127, 0, 0, 1, 0, 0})
+
+	// Verify the first reply
+	out := make([]byte, 12)
+	if _, err := io.ReadAtLeast(conn, out, len(out)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(out[:8], []byte{socks5Version, NoAuth, 5, SuccessReply, 0, 1, 127, 0}) {
+		t.Fatalf("bad: %v", out)
+	}
+	bindPort := binary.BigEndian.Uint16(out[10:])
+
+	// Connect as the peer and send a ping
+	peer, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(int(bindPort))))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer peer.Close()
+	peer.SetDeadline(time.Now().Add(time.Second))
+	peer.Write([]byte("ping"))
+
+	// Verify the second reply carries the peer address
+	peerAddr := peer.LocalAddr().(*net.TCPAddr)
+	expected := []byte{5, SuccessReply, 0, 1, 127, 0, 0, 1, 0, 0, 'p', 'i', 'n', 'g'}
+	binary.BigEndian.PutUint16(expected[8:], uint16(peerAddr.Port))
+	out = make([]byte, len(expected))
+	if _, err := io.ReadAtLeast(conn, out, len(out)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(out, expected) {
+		t.Fatalf("bad: %v", out)
+	}
+
+	// Reply through the proxy
+	conn.Write([]byte("pong"))
+	out = make([]byte, 4)
+	if _, err := io.ReadAtLeast(peer, out, len(out)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(out, []byte("pong")) {
+		t.Fatalf("bad: %v", out)
+	}
+}
+
+// testTLSCert creates a certificate signed by parent, self-signed if parent is nil
+func testTLSCert(t *testing.T, tmpl *x509.Certificate, parent *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	tmpl.SerialNumber = big.NewInt(time.Now().UnixNano())
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.NotAfter = time.Now().Add(time.Hour)
+	parentCert, parentKey := tmpl, any(key)
+	if parent != nil {
+		parentCert, parentKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parentCert, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestSOCKS5_TLS(t *testing.T) {
+	cert := testTLSCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "localhost"},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+	}, nil)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert.Leaf)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	serv, err := New(ctx, testLogger(t), &Config{Rules: PermitNone()})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	go func() {
+		_ = serv.ServeListener(tls.NewListener(l, &tls.Config{Certificates: []tls.Certificate{cert}}))
+	}()
+
+	conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{RootCAs: pool})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+
+	conn.Write([]byte{5, 1, NoAuth, 5, 1, 0, 1, 127, 0, 0, 1, 0, 80})
+	out := make([]byte, 12)
+	if _, err := io.ReadAtLeast(conn, out, len(out)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(out, []byte{socks5Version, NoAuth, 5, RuleFailure, 0, 1, 0, 0, 0, 0, 0, 0}) {
+		t.Fatalf("bad: %v", out)
+	}
+}
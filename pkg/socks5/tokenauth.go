@@ -0,0 +1,191 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+const (
+	// TokenAuth is the private method code used by TokenAuthenticator by default
+	TokenAuth        = uint8(0x80)
+	tokenAuthVersion = uint8(1)
+)
+
+// TokenAuthenticator is used to authenticate machine clients by a bearer token
+// negotiated with a private auth method. After the method is selected
+// the client sends VER(1) LEN(2) TOKEN(LEN), the server replies VER(1) STATUS(1).
+//
+// Tokens are issued with SignToken as kid.claims.signature, where claims is a json
+// object and the signature is HMAC-SHA256 of "kid.claims" with the key named kid.
+// The "sub" claim is the username and "exp" is the expiration time in unix seconds,
+// an optional "nbf" claim delays the start. All claims are exposed in
+// AuthContext.Payload, arrays are comma separated.
+type TokenAuthenticator struct {
+	// Code is the private method code 0x80-0xfe. Defaults to TokenAuth.
+	Code uint8
+
+	// Keys map key ids to signing keys. Keys are rotated by adding the new key,
+	// issuing tokens with it and removing the old key once its tokens expire.
+	Keys map[string][]byte
+
+	// now is used to check the token validity, defaults to time.Now
+	now func() time.Time
+}
+
+func (a TokenAuthenticator) GetCode() uint8 {
+	if a.Code == 0 {
+		return TokenAuth
+	}
+	return a.Code
+}
+
+func (a TokenAuthenticator) Authenticate(_ context.Context, _ *ConnInfo, reader io.Reader, writer io.Writer) (*AuthContext, string, error) {
+	// Tell the client to use token auth
+	if _, err := writer.Write([]byte{socks5Version, a.GetCode()}); err != nil {
+		return nil, "", err
+	}
+
+	// Get the version and token length
+	header := []byte{0, 0, 0}
+	if _, err := io.ReadAtLeast(reader, header, 3); err != nil {
+		return nil, "", err
+	}
+
+	// Ensure we are compatible
+	if header[0] != tokenAuthVersion {
+		return nil, "", fmt.Errorf("unsupported token auth version: %v", header[0])
+	}
+
+	// Get the token
+	token := make([]byte, binary.BigEndian.Uint16(header[1:]))
+	if _, err := io.ReadAtLeast(reader, token, len(token)); err != nil {
+		return nil, "", err
+	}
+
+	// Verify the token
+	payload, err := a.Verify(string(token))
+	if err != nil {
+		_, _ = writer.Write([]byte{tokenAuthVersion, authFailure})
+		return nil, "", fmt.Errorf("token authentication failed: %v", err)
+	}
+	if _, err := writer.Write([]byte{tokenAuthVersion, authSuccess}); err != nil {
+		return nil, "", err
+	}
+	return &AuthContext{a.GetCode(), payload}, payload["Username"], nil
+}
+
+// Verify checks the token signature and validity time and returns its claims.
+// The "sub" claim is returned as Username too.
+func (a TokenAuthenticator) Verify(token string) (map[string]string, error) {
+	kid, rest, _ := strings.Cut(token, ".")
+	encoded, signature, ok := strings.Cut(rest, ".")
+	if !ok {
+		return nil, fmt.Errorf("malformed token")
+	}
+	key, found := a.Keys[kid]
+	if !found {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(sig, tokenSignature(key, kid, encoded)) {
+		return nil, fmt.Errorf("invalid signature")
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("malformed claims: %v", err)
+	}
+	var claims map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	if err := dec.Decode(&claims); err != nil {
+		return nil, fmt.Errorf("malformed claims: %v", err)
+	}
+
+	now := time.Now
+	if a.now != nil {
+		now = a.now
+	}
+	exp, ok := unixClaim(claims, "exp")
+	if !ok {
+		return nil, fmt.Errorf("missing exp claim")
+	}
+	if !now().Before(exp) {
+		return nil, fmt.Errorf("token expired at %v", exp.UTC().Format(time.RFC3339))
+	}
+	if nbf, ok := unixClaim(claims, "nbf"); ok && now().Before(nbf) {
+		return nil, fmt.Errorf("token is not valid before %v", nbf.UTC().Format(time.RFC3339))
+	}
+	sub, _ := claims["sub"].(string)
+	if sub == "" {
+		return nil, fmt.Errorf("missing sub claim")
+	}
+
+	payload := make(map[string]string, len(claims)+1)
+	for k, v := range claims {
+		payload[k] = claimString(v)
+	}
+	payload["Username"] = sub
+	return payload, nil
+}
+
+// SignToken issues a token with the claims signed by the key named kid.
+// The claims have to contain "sub" and "exp".
+func SignToken(kid string, key []byte, claims map[string]interface{}) (string, error) {
+	if strings.Contains(kid, ".") {
+		return "", fmt.Errorf("key id must not contain dots")
+	}
+	raw, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(raw)
+	signature := base64.RawURLEncoding.EncodeToString(tokenSignature(key, kid, encoded))
+	return kid + "." + encoded + "." + signature, nil
+}
+
+func tokenSignature(key []byte, kid, encoded string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(kid + "." + encoded))
+	return mac.Sum(nil)
+}
+
+// unixClaim returns the numeric claim as time
+func unixClaim(claims map[string]interface{}, name string) (time.Time, bool) {
+	n, ok := claims[name].(json.Number)
+	if !ok {
+		return time.Time{}, false
+	}
+	sec, err := n.Int64()
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(sec, 0), true
+}
+
+// claimString formats the claim for AuthContext.Payload
+func claimString(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, e := range v {
+			values = append(values, claimString(e))
+		}
+		return strings.Join(values, ",")
+	case nil:
+		return ""
+	default:
+		return fmt.Sprint(v)
+	}
+}
@@ -0,0 +1,95 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testToken(t *testing.T, kid string, key []byte, claims map[string]interface{}) string {
+	token, err := SignToken(kid, key, claims)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return token
+}
+
+func TestTokenAuthenticator_Verify(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	a := TokenAuthenticator{
+		Keys: map[string][]byte{"k1": []byte("secret1"), "k2": []byte("secret2")},
+		now:  func() time.Time { return now },
+	}
+	exp := now.Add(time.Hour).Unix()
+
+	valid := testToken(t, "k2", []byte("secret2"), map[string]interface{}{"sub": "ci", "exp": exp, "groups": []string{"build", "deploy"}})
+	payload, err := a.Verify(valid)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if payload["Username"] != "ci" || payload["sub"] != "ci" || payload["groups"] != "build,deploy" || payload["exp"] != "1700003600" {
+		t.Fatalf("bad: %v", payload)
+	}
+
+	for _, tc := range []struct {
+		name  string
+		token string
+		err   string
+	}{
+		{"expired", testToken(t, "k1", []byte("secret1"), map[string]interface{}{"sub": "ci", "exp": now.Unix()}), "expired"},
+		{"not yet valid", testToken(t, "k1", []byte("secret1"), map[string]interface{}{"sub": "ci", "exp": exp, "nbf": exp - 1}), "not valid before"},
+		{"wrong key", testToken(t, "k1", []byte("secret2"), map[string]interface{}{"sub": "ci", "exp": exp}), "invalid signature"},
+		{"unknown key", testToken(t, "k3", []byte("secret1"), map[string]interface{}{"sub": "ci", "exp": exp}), "unknown key"},
+		{"no expiration", testToken(t, "k1", []byte("secret1"), map[string]interface{}{"sub": "ci"}), "missing exp"},
+		{"no subject", testToken(t, "k1", []byte("secret1"), map[string]interface{}{"exp": exp}), "missing sub"},
+		{"tampered", strings.Replace(valid, "k2.", "k1.", 1), "invalid signature"},
+		{"malformed", "k1.abc", "malformed"},
+	} {
+		if _, err := a.Verify(tc.token); err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%v: bad: %v", tc.name, err)
+		}
+	}
+}
+
+func TestTokenAuth(t *testing.T) {
+	key := []byte("secret")
+	cator := TokenAuthenticator{Keys: map[string][]byte{"k1": key}}
+	s, _ := New(context.Background(), testLogger(t), &Config{AuthMethods: []Authenticator{cator}})
+
+	for _, tc := range []struct {
+		name     string
+		token    string
+		expected byte
+	}{
+		{"valid", testToken(t, "k1", key, map[string]interface{}{"sub": "ci", "exp": time.Now().Add(time.Minute).Unix()}), authSuccess},
+		{"invalid", testToken(t, "k1", []byte("other"), map[string]interface{}{"sub": "ci", "exp": time.Now().Add(time.Minute).Unix()}), authFailure},
+	} {
+		req := bytes.NewBuffer([]byte{2, NoAuth, TokenAuth, tokenAuthVersion, 0, 0})
+		binary.BigEndian.PutUint16(req.Bytes()[4:], uint16(len(tc.token)))
+		req.WriteString(tc.token)
+		var resp bytes.Buffer
+
+		ctx, user, err := s.authenticate(context.Background(), &ConnInfo{}, &resp, req)
+		if out := resp.Bytes(); !bytes.Equal(out, []byte{socks5Version, TokenAuth, tokenAuthVersion, tc.expected}) {
+			t.Fatalf("%v: bad: %v", tc.name, out)
+		}
+		if tc.expected == authSuccess && (err != nil || user != "ci" || ctx.Method != TokenAuth) {
+			t.Fatalf("%v: bad: %v %v %v", tc.name, ctx, user, err)
+		}
+		if tc.expected == authFailure && err == nil {
+			t.Fatalf("%v: expected error", tc.name)
+		}
+	}
+}
+
+func TestNew_TokenAuthCode(t *testing.T) {
+	for code, valid := range map[uint8]bool{0: true, 0x80: true, 0xfe: true, UserPassAuth: false, 0x7f: false, NoAcceptable: false} {
+		cator := &TokenAuthenticator{Code: code, Keys: map[string][]byte{"k1": []byte("secret")}}
+		if _, err := New(context.Background(), testLogger(t), &Config{AuthMethods: []Authenticator{cator}}); (err == nil) != valid {
+			t.Errorf("%#x: bad: %v", code, err)
+		}
+	}
+}
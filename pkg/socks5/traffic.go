@@ -0,0 +1,165 @@
+package socks5
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Traffic is the data relayed by a session to a destination
+type Traffic struct {
+	// User is the authenticated username, empty for anonymous clients
+	User string
+	// Dest is the requested destination as host:port, the name if the client sent one
+	Dest string
+	// Command of the session
+	Command uint8
+	// Up is the bytes sent by the client to the destination
+	Up int64
+	// Down is the bytes sent by the destination to the client
+	Down int64
+	// Start and End of the session
+	Start time.Time
+	End   time.Time
+}
+
+// TrafficRecorder receives the traffic of every finished session,
+// e.g. to aggregate it for accounting. It is called concurrently.
+// Udp associations are recorded per destination.
+type TrafficRecorder interface {
+	RecordTraffic(t Traffic)
+}
+
+// trafficCounter counts the bytes relayed in both directions
+type trafficCounter struct {
+	start time.Time
+	up    atomic.Int64
+	down  atomic.Int64
+	// data is called with the relayed bytes, e.g. to count them for DataQuota
+	data func(n int64)
+	// perChunk counts the bytes as they are relayed instead of once a direction ends
+	perChunk bool
+	metrics  Metrics
+}
+
+// newTrafficCounter starts counting a session. Relayed bytes of users are counted
+// for DataQuota, stop ends the session once the user is over the quota
+// if CloseOverQuota is set.
+func (s *Server) newTrafficCounter(req *Request, stop func()) *trafficCounter {
+	t := &trafficCounter{start: time.Now(), metrics: s.metrics()}
+	user := requestUser(req)
+	if s.config.DataQuota == nil || user == "" {
+		return t
+	}
+	var once sync.Once
+	t.perChunk = s.config.CloseOverQuota
+	t.data = func(n int64) {
+		if !s.config.DataQuota.AddData(user, n) && s.config.CloseOverQuota {
+			once.Do(func() {
+				req.Lg.Lg.Warn().Msgf("close session to %v: %v", req.DestAddr, DataQuotaExceeded)
+				stop()
+			})
+		}
+	}
+	return t
+}
+
+func (t *trafficCounter) addUp(n int64) {
+	t.up.Add(n)
+	t.metrics.Relayed(n, 0)
+	t.count(n)
+}
+
+func (t *trafficCounter) addDown(n int64) {
+	t.down.Add(n)
+	t.metrics.Relayed(0, n)
+	t.count(n)
+}
+
+func (t *trafficCounter) count(n int64) {
+	if t.data != nil && n > 0 {
+		t.data(n)
+	}
+}
+
+// copyUp relays src to dst counting the bytes sent to the destination
+func (t *trafficCounter) copyUp(dst io.Writer, src io.Reader) error {
+	return t.copy(dst, src, t.addUp)
+}
+
+// copyDown relays src to dst counting the bytes sent to the client
+func (t *trafficCounter) copyDown(dst io.Writer, src io.Reader) error {
+	return t.copy(dst, src, t.addDown)
+}
+
+// copy relays src to dst. Unless the bytes are counted per chunk the total is added
+// at the end, so io.Copy keeps the ReadFrom and WriteTo fast paths of the connections.
+func (t *trafficCounter) copy(dst io.Writer, src io.Reader, add func(n int64)) error {
+	if t.perChunk {
+		_, err := io.Copy(countingWriter{dst, add}, src)
+		return err
+	}
+	n, err := io.Copy(dst, src)
+	add(n)
+	return err
+}
+
+// stopConn interrupts the relay of the connection
+func stopConn(c net.Conn) func() {
+	return func() {
+		_ = c.SetDeadline(time.Now())
+	}
+}
+
+// recordTraffic passes the counted traffic to the TrafficRecorder
+func (s *Server) recordTraffic(req *Request, dest *AddrSpec, t *trafficCounter) {
+	up, down := t.up.Load(), t.down.Load()
+	req.Lg.Lg.Debug().Msgf("relayed %v: %v bytes up, %v bytes down", dest, up, down)
+	if s.config.Traffic == nil {
+		return
+	}
+	s.config.Traffic.RecordTraffic(Traffic{
+		User:    requestUser(req),
+		Dest:    trafficDest(dest),
+		Command: req.Command,
+		Up:      up,
+		Down:    down,
+		Start:   t.start,
+		End:     time.Now(),
+	})
+}
+
+// trafficDest returns the destination host:port, names are preferred over ips
+func trafficDest(a *AddrSpec) string {
+	if a.FQDN != "" {
+		return net.JoinHostPort(a.FQDN, strconv.Itoa(a.Port))
+	}
+	return a.Address()
+}
+
+// countingWriter passes the written bytes to add
+type countingWriter struct {
+	w   io.Writer
+	add func(n int64)
+}
+
+func (c countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.add(int64(n))
+	return n, err
+}
+
+// countingReader passes the read bytes to add
+type countingReader struct {
+	r   io.Reader
+	add func(n int64)
+}
+
+func (c countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.add(int64(n))
+	return n, err
+}
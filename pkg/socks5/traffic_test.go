@@ -0,0 +1,109 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// testTraffic collects the recorded traffic
+type testTraffic struct {
+	mu      sync.Mutex
+	records []Traffic
+}
+
+func (r *testTraffic) RecordTraffic(t Traffic) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.records = append(r.records, t)
+}
+
+func TestRequest_ConnectTraffic(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			t.Errorf("err: %v", err)
+			return
+		}
+		defer conn.Close()
+		io.ReadAtLeast(conn, make([]byte, 4), 4)
+		conn.Write([]byte("pong pong"))
+	}()
+	lAddr := l.Addr().(*net.TCPAddr)
+
+	recorder := &testTraffic{}
+	s := &Server{ctx: context.Background(), config: &Config{
+		Rules:    PermitAll(),
+		Resolver: staticResolver{lAddr.IP},
+		Traffic:  recorder,
+	}}
+
+	// Connect by name to count the traffic of the requested destination
+	buf := bytes.NewBuffer(nil)
+	buf.Write([]byte{5, 1, 0, 3, 9})
+	buf.WriteString("localhost")
+	port := []byte{0, 0}
+	binary.BigEndian.PutUint16(port, uint16(lAddr.Port))
+	buf.Write(port)
+	buf.Write([]byte("ping"))
+
+	req, err := NewRequest(uuid.New(), testLogger(t), buf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	req.AuthContext = &AuthContext{UserPassAuth, map[string]string{"Username": "foo"}}
+	if err := s.handleRequest(context.Background(), req, &MockConn{}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if len(recorder.records) != 1 {
+		t.Fatalf("bad: %v", recorder.records)
+	}
+	r := recorder.records[0]
+	if r.User != "foo" || r.Dest != "localhost:"+strconv.Itoa(lAddr.Port) || r.Command != ConnectCommand ||
+		r.Up != 4 || r.Down != 9 || r.End.Before(r.Start) {
+		t.Fatalf("bad: %+v", r)
+	}
+}
+
+// readerFromBuffer records whether io.Copy used ReadFrom
+type readerFromBuffer struct {
+	bytes.Buffer
+	readFrom bool
+}
+
+func (b *readerFromBuffer) ReadFrom(r io.Reader) (int64, error) {
+	b.readFrom = true
+	return b.Buffer.ReadFrom(r)
+}
+
+func TestTrafficCounter_Copy(t *testing.T) {
+	for _, perChunk := range []bool{false, true} {
+		var chunks []int64
+		traffic := &trafficCounter{metrics: noMetrics{}, perChunk: perChunk, data: func(n int64) {
+			chunks = append(chunks, n)
+		}}
+		dst := &readerFromBuffer{}
+		if err := traffic.copyUp(dst, struct{ io.Reader }{io.MultiReader(bytes.NewReader(make([]byte, 3)), bytes.NewReader(make([]byte, 4)))}); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if traffic.up.Load() != 7 || dst.Len() != 7 {
+			t.Fatalf("%v: bad: %v %v", perChunk, traffic.up.Load(), dst.Len())
+		}
+		// Counting per chunk wraps the writer, the total keeps the ReadFrom fast path
+		if dst.readFrom == perChunk || (perChunk && len(chunks) != 2) || (!perChunk && len(chunks) != 1) {
+			t.Fatalf("%v: bad: %v %v", perChunk, dst.readFrom, chunks)
+		}
+	}
+}